@@ -4,12 +4,36 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
+	"strings"
 )
 
 // The protocol aims to be a suitable implementation of
 // https://github.com/git-lfs/git-lfs/blob/main/docs/custom-transfers.md,
 // nothing more, nothing less.
 
+// Error codes sent to git-lfs. They follow HTTP status codes where one
+// applies, so that failures can be told apart.
+const (
+	// Any other error.
+	CodeError = 1
+	// Reading or writing local files failed, e.g. because the disk is full.
+	CodeLocalIO = 2
+	// The request from git-lfs is invalid.
+	CodeBadRequest = 400
+	// The credentials are invalid or lack permissions.
+	CodeAccessDenied = 403
+	// The object does not exist in the storage.
+	CodeNotFound = 404
+	// The stored object differs from the expected one, or changed during the
+	// transfer.
+	CodeMismatch = 409
+	// The storage is unavailable or overloaded; retrying later may succeed.
+	CodeUnavailable = 503
+	// The transfer did not complete before its deadline.
+	CodeTimeout = 504
+)
+
 // Header struct
 type Header struct {
 	Key   string `json:"key"`
@@ -64,10 +88,10 @@ type ProgressResponse struct {
 }
 
 // SendResponse sends an actual response to lfs
-func SendResponse(r interface{}, writer io.Writer, stderr io.Writer) error {
+func SendResponse(r interface{}, writer io.Writer) error {
 	b, err := json.Marshal(r)
 	if err != nil {
-		fmt.Fprintf(stderr, "Error marshalling response: %s", err)
+		slog.Error("Error marshalling response", "error", err)
 		return err
 	}
 	// Line oriented JSON
@@ -76,30 +100,31 @@ func SendResponse(r interface{}, writer io.Writer, stderr io.Writer) error {
 	if err != nil {
 		return err
 	}
-	fmt.Fprintf(stderr, "Sent message %v", string(b))
+	slog.Debug("Sent message", "message", strings.TrimSpace(string(b)))
 	return nil
 }
 
 // SendInit answers to init
-func SendInit(code int, err error, writer io.Writer, stderr io.Writer) {
+func SendInit(code int, err error, writer io.Writer) {
 	var resp *InitResponse
 	if err != nil {
 		resp = &InitResponse{&Error{code, fmt.Sprintf("Init error: %s\n", err)}}
 	} else {
 		resp = &InitResponse{}
 	}
-	respErr := SendResponse(resp, writer, stderr)
+	respErr := SendResponse(resp, writer)
 	if respErr != nil {
-		fmt.Fprintf(stderr, "Unable to send init response: %v\n", respErr)
+		slog.Error("Unable to send init response", "error", respErr)
 	}
 }
 
-// SendTransfer sends a transfer message back to lfs
-func SendTransfer(oid string, code int, err error, path string, writer io.Writer, stderr io.Writer) {
+// SendTransfer sends a transfer message back to lfs, answering a request of
+// the given event, upload or download
+func SendTransfer(event string, oid string, code int, err error, path string, writer io.Writer) {
 	var resp *TransferResponse
 	if err != nil {
 		var message string
-		if path == "" {  // always empty on upload
+		if event == "upload" {
 			message = fmt.Sprintf("Error uploading file: %v\n", err)
 		} else {
 			message = fmt.Sprintf("Error downloading file: %v\n", err)
@@ -112,17 +137,17 @@ func SendTransfer(oid string, code int, err error, path string, writer io.Writer
 			resp = &TransferResponse{Event: "complete", Oid: oid, Path: path, Error: nil}
 		}
 	}
-	respErr := SendResponse(resp, writer, stderr)
+	respErr := SendResponse(resp, writer)
 	if respErr != nil {
-		fmt.Fprintf(stderr, "Unable to send transfer message: %v\n", respErr)
+		slog.Error("Unable to send transfer message", "oid", oid, "error", respErr)
 	}
 }
 
 // SendProgress reports progress on operations
-func SendProgress(oid string, bytesSoFar int64, bytesSinceLast int, writer io.Writer, stderr io.Writer) {
+func SendProgress(oid string, bytesSoFar int64, bytesSinceLast int, writer io.Writer) {
 	resp := &ProgressResponse{"progress", oid, bytesSoFar, bytesSinceLast}
-	err := SendResponse(resp, writer, stderr)
+	err := SendResponse(resp, writer)
 	if err != nil {
-		fmt.Fprintf(stderr, "Unable to send progress update: %v\n", err)
+		slog.Error("Unable to send progress update", "oid", oid, "error", err)
 	}
 }
@@ -0,0 +1,76 @@
+// Package backend defines the storage LFS objects are kept in.
+//
+// Keys are relative to the root of the storage, e.g. the LFS object ID
+// followed by the extension of the compression used to store the object.
+package backend
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned (possibly wrapped) when an object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// ErrAccessDenied is returned (possibly wrapped) when the credentials lack the
+// permission for an operation. S3 also denies reading missing objects to
+// credentials which cannot list the bucket.
+var ErrAccessDenied = errors.New("access denied")
+
+// ErrChanged is returned (possibly wrapped) when an object no longer has the
+// expected ETag.
+var ErrChanged = errors.New("object changed")
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key  string
+	Size int64
+	// Identifies the content of the object, which changes when it is replaced.
+	ETag string
+	// Base64-encoded CRC32C checksum of the stored bytes, empty if unknown.
+	ChecksumCRC32C string
+	// Metadata stored along with the object. Keys are lowercase.
+	Metadata map[string]string
+}
+
+// Backend stores objects by key.
+type Backend interface {
+	// Stat returns information about an object, including its metadata, or
+	// ErrNotFound.
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// Put stores the content of body and its metadata under key, replacing
+	// any existing object. Metadata keys must be lowercase.
+	Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error
+	// Get writes the content of an object to dest, in order.
+	Get(ctx context.Context, key string, dest io.Writer) error
+	// GetRange returns length bytes of an object, starting at offset. If etag
+	// is not empty and the object has a different ETag, ErrChanged is returned.
+	GetRange(ctx context.Context, key string, offset, length int64, etag string) (io.ReadCloser, error)
+	// Delete removes an object.
+	Delete(ctx context.Context, key string) error
+}
+
+// Lister is implemented by backends which list the objects with a prefix in
+// about the time they check one, e.g. S3 with a single request. The stored
+// versions of an object are found with one listing on such backends, and by
+// checking each version on others.
+type Lister interface {
+	// List returns the objects whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// Opener opens a backend, checking that it is configured correctly and that
+// the storage can be reached.
+type Opener func(ctx context.Context) (Backend, error)
+
+// Resumable is implemented by backends which can resume interrupted uploads
+// across runs, keeping track of them in a local directory.
+type Resumable interface {
+	// SetStateDir sets the directory upload state is kept in. It is created
+	// when needed. Uploads interrupted long ago are discarded.
+	SetStateDir(ctx context.Context, dir string)
+	// DiscardUpload discards the interrupted upload of key, if any, once it
+	// is no longer needed, e.g. because the object was stored meanwhile.
+	DiscardUpload(ctx context.Context, key string)
+}
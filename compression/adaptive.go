@@ -0,0 +1,31 @@
+package compression
+
+import (
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// SampleSize is the size of the sample of a file used to estimate how well
+// it compresses.
+const SampleSize = 1024 * 1024
+
+var sampleEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+})
+
+// EstimateRatio returns the ratio between the size of sample and its size
+// once quickly compressed, as an estimate of how well the file it was taken
+// from compresses. Already compressed content, e.g. images, videos or
+// archives, has a ratio close to 1.
+func EstimateRatio(sample []byte) (float64, error) {
+	if len(sample) == 0 {
+		return 1, nil
+	}
+	enc, err := sampleEncoder()
+	if err != nil {
+		return 0, err
+	}
+	compressed := enc.EncodeAll(sample, nil)
+	return float64(len(sample)) / float64(len(compressed)), nil
+}
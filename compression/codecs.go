@@ -0,0 +1,212 @@
+package compression
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// readPipe returns a reader of what encode writes, in a goroutine, and a
+// function waiting for the goroutine to end.
+func readPipe(encode func(w io.Writer) error) (io.Reader, func()) {
+	r, w := io.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := encode(w); err != nil {
+			w.CloseWithError(err)
+		} else {
+			w.Close()
+		}
+	}()
+	return r, func() {
+		// Closing first unblocks the encoder if the reader was abandoned early.
+		r.Close()
+		wg.Wait()
+	}
+}
+
+// encodePipe compresses source in a goroutine, with the encoder returned by
+// newWriter.
+func encodePipe(source io.Reader, newWriter func(w io.Writer) (io.WriteCloser, error)) (io.Reader, func()) {
+	return readPipe(func(w io.Writer) error {
+		enc, err := newWriter(w)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(enc, source); err != nil {
+			enc.Close()
+			return err
+		}
+		return enc.Close()
+	})
+}
+
+// decodePipe decompresses what is written to dest in a goroutine, with the
+// decoder returned by newReader.
+func decodePipe(dest io.Writer, newReader func(r io.Reader) (io.Reader, error)) (io.Writer, func()) {
+	r, w := io.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := func() error {
+			dec, err := newReader(r)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(dest, dec)
+			return err
+		}(); err != nil {
+			r.CloseWithError(err)
+		} else {
+			r.Close()
+		}
+	}()
+	return w, func() {
+		w.Close()
+		wg.Wait()
+	}
+}
+
+// Xz compresses files with LZMA2, slowly but to smaller files than zstd.
+type Xz struct {
+	// Size of the dictionary in which matches are looked for. Decompressing
+	// needs as much memory. 0 for 8 MB.
+	DictSize int
+}
+
+func (x *Xz) Name() string      { return "xz" }
+func (x *Xz) Extension() string { return ".xz" }
+func (x *Xz) Configure(options string) (Compression, error) {
+	c := &Xz{}
+	err := parseOptions(options, func(key, value string) (err error) {
+		switch key {
+		case "window":
+			c.DictSize, err = parseSize(value)
+		default:
+			err = fmt.Errorf("unknown option %s", key)
+		}
+		return
+	})
+	if err == nil {
+		config := c.writerConfig()
+		err = config.Verify()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid xz options %q: %v", options, err)
+	}
+	return c, nil
+}
+
+func (x *Xz) writerConfig() xz.WriterConfig {
+	return xz.WriterConfig{DictCap: x.DictSize}
+}
+
+func (x *Xz) WrapRead(source io.Reader) (io.Reader, func()) {
+	return encodePipe(source, func(w io.Writer) (io.WriteCloser, error) {
+		return x.writerConfig().NewWriter(w)
+	})
+}
+func (x *Xz) WrapWrite(dest io.Writer) (io.Writer, func()) {
+	return decodePipe(dest, func(r io.Reader) (io.Reader, error) {
+		return xz.NewReader(r)
+	})
+}
+
+// Lz4 compresses files very fast, but less than the other compressions.
+type Lz4 struct {
+	// Level from 1 to 9. 0 for the fastest compression.
+	Level int
+}
+
+func (l *Lz4) Name() string      { return "lz4" }
+func (l *Lz4) Extension() string { return ".lz4" }
+func (l *Lz4) Configure(options string) (Compression, error) {
+	c := &Lz4{}
+	err := parseOptions(options, func(key, value string) (err error) {
+		switch key {
+		case "level":
+			c.Level, err = parseLevel(value, 1, 9)
+		default:
+			err = fmt.Errorf("unknown option %s", key)
+		}
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid lz4 options %q: %v", options, err)
+	}
+	return c, nil
+}
+
+func (l *Lz4) WrapRead(source io.Reader) (io.Reader, func()) {
+	return encodePipe(source, func(w io.Writer) (io.WriteCloser, error) {
+		level := lz4.Fast
+		if l.Level != 0 {
+			level = lz4.CompressionLevel(1 << (8 + l.Level))
+		}
+		zw := lz4.NewWriter(w)
+		err := zw.Apply(lz4.CompressionLevelOption(level), lz4.ChecksumOption(true))
+		return zw, err
+	})
+}
+func (l *Lz4) WrapWrite(dest io.Writer) (io.Writer, func()) {
+	return decodePipe(dest, func(r io.Reader) (io.Reader, error) {
+		return lz4.NewReader(r), nil
+	})
+}
+
+// S2 compresses files very fast, with a ratio between lz4 and zstd.
+type S2 struct {
+	// Level from 1 (default) to 3 (best).
+	Level int
+	// Number of goroutines compressing each file. 0 for GOMAXPROCS.
+	Concurrency int
+}
+
+func (s *S2) Name() string      { return "s2" }
+func (s *S2) Extension() string { return ".s2" }
+func (s *S2) Configure(options string) (Compression, error) {
+	c := &S2{}
+	err := parseOptions(options, func(key, value string) (err error) {
+		switch key {
+		case "level":
+			c.Level, err = parseLevel(value, 1, 3)
+		case "concurrency":
+			c.Concurrency, err = parseLevel(value, 1, 1024)
+		default:
+			err = fmt.Errorf("unknown option %s", key)
+		}
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid s2 options %q: %v", options, err)
+	}
+	return c, nil
+}
+
+func (s *S2) WrapRead(source io.Reader) (io.Reader, func()) {
+	return encodePipe(source, func(w io.Writer) (io.WriteCloser, error) {
+		var opts []s2.WriterOption
+		switch s.Level {
+		case 2:
+			opts = append(opts, s2.WriterBetterCompression())
+		case 3:
+			opts = append(opts, s2.WriterBestCompression())
+		}
+		if s.Concurrency != 0 {
+			opts = append(opts, s2.WriterConcurrency(s.Concurrency))
+		}
+		return s2.NewWriter(w, opts...), nil
+	})
+}
+func (s *S2) WrapWrite(dest io.Writer) (io.Writer, func()) {
+	return decodePipe(dest, func(r io.Reader) (io.Reader, error) {
+		return s2.NewReader(r), nil
+	})
+}
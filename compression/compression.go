@@ -2,7 +2,9 @@ package compression
 
 import (
 	"compress/gzip"
+	"fmt"
 	"io"
+	"strings"
 	"sync"
 
 	"github.com/klauspost/compress/zstd"
@@ -15,8 +17,33 @@ type Compression interface {
 	WrapWrite(dest io.Writer) (io.Writer, func())
 }
 
-// In order of download preference. First item is the default for uploading files.
-var Compressions = []Compression{&Zstd{}, &Gzip{}, &None{}}
+// Configurable is implemented by compressions which take options, e.g. a
+// level. Options only change how files are compressed, so files compressed
+// with any options are read the same way.
+type Configurable interface {
+	Compression
+	// Configure returns a new compression with the given options, a comma
+	// separated list of a level and key=value pairs.
+	Configure(options string) (Compression, error)
+}
+
+// Parse returns the registered compression described by spec, a name optionally followed
+// by options, e.g. "zstd:3" or "zstd:level=19,window=64M".
+func Parse(spec string) (Compression, error) {
+	name, options, hasOptions := strings.Cut(spec, ":")
+	c, ok := Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %s", name)
+	}
+	if !hasOptions {
+		return c, nil
+	}
+	configurable, ok := c.(Configurable)
+	if !ok {
+		return nil, fmt.Errorf("compression %s takes no options", name)
+	}
+	return configurable.Configure(options)
+}
 
 type None struct{}
 
@@ -25,38 +52,38 @@ func (n *None) Extension() string                             { return "" }
 func (n *None) WrapRead(source io.Reader) (io.Reader, func()) { return source, func() {} }
 func (n *None) WrapWrite(dest io.Writer) (io.Writer, func())  { return dest, func() {} }
 
-type Gzip struct{}
+type Gzip struct {
+	// Level from gzip.BestSpeed (1) to gzip.BestCompression (9). 0 for the
+	// best compression.
+	Level int
+}
 
 func (g *Gzip) Name() string      { return "gzip" }
 func (g *Gzip) Extension() string { return ".gz" }
-func (g *Gzip) WrapRead(source io.Reader) (io.Reader, func()) {
-	r, w := io.Pipe()
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		if err := func() error {
-			defer wg.Done()
-			zip, err := gzip.NewWriterLevel(w, gzip.BestCompression)
-			if err != nil {
-				return err
-			}
-
-			_, err = io.Copy(zip, source)
-			if err != nil {
-				return err
-			}
-
-			return zip.Close()
-		}(); err != nil {
-			w.CloseWithError(err)
-		} else {
-			w.Close()
+func (g *Gzip) Configure(options string) (Compression, error) {
+	c := &Gzip{}
+	err := parseOptions(options, func(key, value string) (err error) {
+		switch key {
+		case "level":
+			c.Level, err = parseLevel(value, gzip.BestSpeed, gzip.BestCompression)
+		default:
+			err = fmt.Errorf("unknown option %s", key)
 		}
-	}()
-	return r, func() {
-		wg.Wait()
-		r.Close()
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip options %q: %v", options, err)
 	}
+	return c, nil
+}
+func (g *Gzip) WrapRead(source io.Reader) (io.Reader, func()) {
+	return encodePipe(source, func(w io.Writer) (io.WriteCloser, error) {
+		level := g.Level
+		if level == 0 {
+			level = gzip.BestCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	})
 }
 func (g *Gzip) WrapWrite(dest io.Writer) (io.Writer, func()) {
 	r, w := io.Pipe()
@@ -88,41 +115,85 @@ func (g *Gzip) WrapWrite(dest io.Writer) (io.Writer, func()) {
 	}
 }
 
-type Zstd struct{}
+type Zstd struct {
+	ZstdOptions
+	// Number of goroutines compressing each file. 0 for GOMAXPROCS.
+	Concurrency int
+}
 
-func (g *Zstd) Name() string      { return "zstd" }
-func (g *Zstd) Extension() string { return ".zstd" }
-func (g *Zstd) WrapRead(source io.Reader) (io.Reader, func()) {
-	r, w := io.Pipe()
-	var wg sync.WaitGroup
-	wg.Add(1)
+// ZstdOptions are the options of zstd encoders shared by Zstd and
+// ZstdSeekable. The zero value gives the best compression.
+type ZstdOptions struct {
+	// Level as passed to the zstd command, from 1 to 22. The encoder only has
+	// 4 levels, to which these are mapped. 0 for the best compression.
+	Level int
+	// Size of the window in which matches are looked for, a power of 2.
+	// Decompressing needs as much memory. 0 for the level's default.
+	WindowSize int
+}
 
-	go func() {
-		defer wg.Done()
-		if err := func() error {
-			zip, err := zstd.NewWriter(w,
-				zstd.WithEncoderLevel(zstd.SpeedBestCompression),
-				zstd.WithEncoderCRC(true))
-			if err != nil {
-				return err
-			}
+func (o ZstdOptions) encoderOptions() []zstd.EOption {
+	level := zstd.SpeedBestCompression
+	if o.Level != 0 {
+		level = zstd.EncoderLevelFromZstd(o.Level)
+	}
+	opts := []zstd.EOption{zstd.WithEncoderLevel(level), zstd.WithEncoderCRC(true)}
+	if o.WindowSize != 0 {
+		opts = append(opts, zstd.WithWindowSize(o.WindowSize))
+	}
+	return opts
+}
 
-			_, err = io.Copy(zip, source)
-			if err != nil {
-				return err
-			}
+// set sets an option, returning false if key is not one of ZstdOptions.
+func (o *ZstdOptions) set(key, value string) (bool, error) {
+	var err error
+	switch key {
+	case "level":
+		o.Level, err = parseLevel(value, 1, 22)
+	case "window":
+		o.WindowSize, err = parseSize(value)
+	default:
+		return false, nil
+	}
+	return true, err
+}
 
-			return zip.Close()
-		}(); err != nil {
-			w.CloseWithError(err)
-		} else {
-			w.Close()
+func (g *Zstd) Name() string      { return "zstd" }
+func (g *Zstd) Extension() string { return ".zstd" }
+func (g *Zstd) Configure(options string) (Compression, error) {
+	c := &Zstd{}
+	err := parseOptions(options, func(key, value string) error {
+		if ok, err := c.set(key, value); ok {
+			return err
 		}
-	}()
-	return r, func() {
-		wg.Wait()
-		r.Close()
+		if key != "concurrency" {
+			return fmt.Errorf("unknown option %s", key)
+		}
+		var err error
+		c.Concurrency, err = parseLevel(value, 1, 1024)
+		return err
+	})
+	if err == nil {
+		// Checks the window size.
+		_, err = zstd.NewWriter(nil, c.encoderOptions()...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid zstd options %q: %v", options, err)
+	}
+	return c, nil
+}
+
+func (g *Zstd) encoderOptions() []zstd.EOption {
+	opts := g.ZstdOptions.encoderOptions()
+	if g.Concurrency != 0 {
+		opts = append(opts, zstd.WithEncoderConcurrency(g.Concurrency))
 	}
+	return opts
+}
+func (g *Zstd) WrapRead(source io.Reader) (io.Reader, func()) {
+	return encodePipe(source, func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w, g.encoderOptions()...)
+	})
 }
 func (g *Zstd) WrapWrite(dest io.Writer) (io.Writer, func()) {
 	r, w := io.Pipe()
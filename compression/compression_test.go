@@ -0,0 +1,101 @@
+package compression
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseOptions(t *testing.T) {
+	data := bytes.Repeat([]byte("lfs-s3 compression levels "), 10000)
+	for _, spec := range []string{"gzip:1", "zstd:3", "zstd:level=19,window=64K,concurrency=2", "zstd-seekable:1,window=1M", "xz:window=1M", "lz4:9", "s2:3,concurrency=2"} {
+		c, err := Parse(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		def, _ := Parse(c.Name())
+		if c == def || c.Extension() != def.Extension() {
+			t.Fatalf("%s: expected a new compression with the extension %s", spec, def.Extension())
+		}
+
+		reader, closeReader := c.WrapRead(bytes.NewReader(data))
+		stream, err := io.ReadAll(reader)
+		closeReader()
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		// Files are decoded the same way whatever the options.
+		var decoded bytes.Buffer
+		writer, closeWriter := def.WrapWrite(&decoded)
+		writer.Write(stream)
+		closeWriter()
+		if !bytes.Equal(decoded.Bytes(), data) {
+			t.Fatalf("%s: decoded content differs", spec)
+		}
+	}
+
+	if c, err := Parse("zstd:3"); err != nil || c.(*Zstd).Level != 3 {
+		t.Fatalf("expected level 3, got %v, %v", c, err)
+	}
+	for _, spec := range []string{"none:1", "gzip:10", "gzip:window=1M", "zstd:0", "zstd:fast", "zstd:window=1000", "zstd-seekable:concurrency=2", "xz:1", "lz4:10", "s2:window=1M", "brotli:1"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+// identity is a trivial compression, as programs embedding the service could
+// register.
+type identity struct{ None }
+
+func (r *identity) Name() string      { return "test-identity" }
+func (r *identity) Extension() string { return ".test-identity" }
+
+// restoreRegistry restores the registry as it is once the test is over, so
+// that compressions registered by the test are not seen by others.
+func restoreRegistry(t *testing.T) {
+	registryMu.Lock()
+	saved := slices.Clone(registry)
+	registryMu.Unlock()
+	t.Cleanup(func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		registry = saved
+	})
+}
+
+func TestRegister(t *testing.T) {
+	restoreRegistry(t)
+	Register(&identity{}, 75)
+
+	var names []string
+	for _, c := range Registered() {
+		names = append(names, c.Name())
+	}
+	want := "zstd zstd-seekable xz test-identity gzip s2 lz4 none"
+	if got := strings.Join(names, " "); got != want {
+		t.Fatalf("expected compressions %s, got %s", want, got)
+	}
+	if c, err := Parse("test-identity"); err != nil || c.Extension() != ".test-identity" {
+		t.Fatalf("expected the registered compression, got %v, %v", c, err)
+	}
+	if c, ok := ForExtension(".gz"); !ok || c.Name() != "gzip" {
+		t.Fatalf("expected gzip, got %v", c)
+	}
+	if Default().Name() != "zstd" {
+		t.Fatalf("expected zstd as default, got %s", Default().Name())
+	}
+
+	for _, c := range []Compression{&identity{}, &Gzip{}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected registering twice to panic", c.Name())
+				}
+			}()
+			Register(c, 1)
+		}()
+	}
+}
@@ -0,0 +1,52 @@
+package compression
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseOptions calls set for each option of a comma separated list. A bare
+// number is the level.
+func parseOptions(options string, set func(key, value string) error) error {
+	for _, option := range strings.Split(options, ",") {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok {
+			key, value = "level", option
+		}
+		if err := set(strings.TrimSpace(key), strings.TrimSpace(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseLevel(value string, min, max int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("expected a number from %d to %d, got %q", min, max, value)
+	}
+	return n, nil
+}
+
+// parseSize parses a number of bytes with an optional K, M or G binary suffix.
+func parseSize(value string) (int, error) {
+	shift := 0
+	switch {
+	case strings.HasSuffix(value, "K"):
+		shift = 10
+	case strings.HasSuffix(value, "M"):
+		shift = 20
+	case strings.HasSuffix(value, "G"):
+		shift = 30
+	}
+	digits := value
+	if shift != 0 {
+		digits = value[:len(value)-1]
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("expected a size, e.g. 8M, got %q", value)
+	}
+	return n << shift, nil
+}
@@ -0,0 +1,101 @@
+package compression
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+type registration struct {
+	compression Compression
+	priority    int
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   []registration
+)
+
+func init() {
+	Register(&Zstd{}, 100)
+	Register(&ZstdSeekable{}, 90)
+	Register(&Xz{}, 80)
+	Register(&Gzip{}, 70)
+	Register(&S2{}, 60)
+	Register(&Lz4{}, 50)
+	Register(&None{}, 0)
+}
+
+// Register makes a compression available to upload and download files with.
+// Downloads look for files stored with each compression in order of
+// decreasing priority, and the compression with the highest priority is the
+// default for uploading. Compressions of equal priority keep the order in
+// which they were registered. Programs embedding the service register their
+// own compressions from an init function, or at least before serving.
+//
+// Register panics if the name or extension of c is already registered, since
+// files could then be read with the wrong compression.
+func Register(c Compression, priority int) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, r := range registry {
+		if r.compression.Name() == c.Name() {
+			panic(fmt.Sprintf("compression: %s registered twice", c.Name()))
+		}
+		if r.compression.Extension() == c.Extension() {
+			panic(fmt.Sprintf("compression: %s registered with the extension %q of %s", c.Name(), c.Extension(), r.compression.Name()))
+		}
+	}
+	i := len(registry)
+	for i > 0 && registry[i-1].priority < priority {
+		i--
+	}
+	registry = slices.Insert(registry, i, registration{c, priority})
+}
+
+// Registered returns the registered compressions in order of download
+// preference.
+func Registered() []Compression {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	compressions := make([]Compression, len(registry))
+	for i, r := range registry {
+		compressions[i] = r.compression
+	}
+	return compressions
+}
+
+// Default returns the compression with the highest priority.
+func Default() Compression {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if len(registry) == 0 {
+		return nil
+	}
+	return registry[0].compression
+}
+
+// Lookup returns the registered compression with the given name.
+func Lookup(name string) (Compression, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for _, r := range registry {
+		if r.compression.Name() == name {
+			return r.compression, true
+		}
+	}
+	return nil, false
+}
+
+// ForExtension returns the registered compression of files stored with the
+// given extension.
+func ForExtension(ext string) (Compression, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for _, r := range registry {
+		if r.compression.Extension() == ext {
+			return r.compression, true
+		}
+	}
+	return nil, false
+}
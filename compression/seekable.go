@@ -0,0 +1,193 @@
+package compression
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Frame is an independently compressed part of a stream.
+type Frame struct {
+	// Position of the frame in the compressed stream.
+	Offset int64
+	Size   int64
+	// Position of the frame content in the decompressed stream.
+	DecompressedOffset int64
+	DecompressedSize   int64
+}
+
+// Framed is implemented by compressions whose streams are made of
+// independently compressed frames, which can be downloaded and decompressed
+// in any order.
+type Framed interface {
+	Compression
+	// ReadIndex returns the frames of a compressed stream of the given size,
+	// using readTail to read the last bytes of the stream.
+	ReadIndex(size int64, readTail func(length int64) ([]byte, error)) ([]Frame, error)
+	// DecodeFrame decompresses a single frame, appending it to dst.
+	DecodeFrame(src, dst []byte) ([]byte, error)
+}
+
+// ZstdSeekable produces streams in the zstd seekable format: zstd frames of
+// SeekableFrameSize uncompressed bytes each, followed by a seek table in a
+// skippable frame. Regular zstd decoders ignore the seek table, see
+// https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md.
+type ZstdSeekable struct {
+	ZstdOptions
+
+	decoderOnce sync.Once
+	decoder     *zstd.Decoder
+	decoderErr  error
+}
+
+// Uncompressed size of the frames of ZstdSeekable streams.
+const SeekableFrameSize = 4 * 1024 * 1024
+
+const (
+	seekTableMagic    = 0x184D2A5E
+	seekableMagic     = 0x8F92EAB1
+	seekFooterSize    = 9
+	seekChecksumFlag  = 1 << 7
+	skippableHeadSize = 8
+)
+
+func (z *ZstdSeekable) Name() string      { return "zstd-seekable" }
+func (z *ZstdSeekable) Extension() string { return ".seekable.zstd" }
+
+// Configure takes the options of Zstd except concurrency, since frames are
+// compressed one at a time.
+func (z *ZstdSeekable) Configure(options string) (Compression, error) {
+	c := &ZstdSeekable{}
+	err := parseOptions(options, func(key, value string) error {
+		if ok, err := c.set(key, value); ok {
+			return err
+		}
+		return fmt.Errorf("unknown option %s", key)
+	})
+	if err == nil {
+		_, err = zstd.NewWriter(nil, c.encoderOptions()...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid zstd-seekable options %q: %v", options, err)
+	}
+	return c, nil
+}
+func (z *ZstdSeekable) WrapRead(source io.Reader) (io.Reader, func()) {
+	return readPipe(func(w io.Writer) error {
+		enc, err := zstd.NewWriter(nil, append(z.encoderOptions(), zstd.WithEncoderConcurrency(1))...)
+		if err != nil {
+			return err
+		}
+		defer enc.Close()
+
+		var table []byte
+		var frames uint32
+		chunk := make([]byte, SeekableFrameSize)
+		var frame []byte
+		for {
+			n, err := io.ReadFull(source, chunk)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			frame = enc.EncodeAll(chunk[:n], frame[:0])
+			if _, err := w.Write(frame); err != nil {
+				return err
+			}
+			table = binary.LittleEndian.AppendUint32(table, uint32(len(frame)))
+			table = binary.LittleEndian.AppendUint32(table, uint32(n))
+			frames++
+			if n < len(chunk) {
+				break
+			}
+		}
+
+		seekTable := binary.LittleEndian.AppendUint32(nil, seekTableMagic)
+		seekTable = binary.LittleEndian.AppendUint32(seekTable, uint32(len(table)+seekFooterSize))
+		seekTable = append(seekTable, table...)
+		seekTable = binary.LittleEndian.AppendUint32(seekTable, frames)
+		seekTable = append(seekTable, 0)
+		seekTable = binary.LittleEndian.AppendUint32(seekTable, seekableMagic)
+		_, err = w.Write(seekTable)
+		return err
+	})
+}
+
+// WrapWrite decompresses streams sequentially, like regular zstd streams.
+func (z *ZstdSeekable) WrapWrite(dest io.Writer) (io.Writer, func()) {
+	return (&Zstd{}).WrapWrite(dest)
+}
+
+// errTruncated is returned when readTail returns fewer bytes than asked.
+var errTruncated = errors.New("invalid seekable zstd stream: truncated")
+
+func (z *ZstdSeekable) ReadIndex(size int64, readTail func(length int64) ([]byte, error)) ([]Frame, error) {
+	if size < skippableHeadSize+seekFooterSize {
+		return nil, fmt.Errorf("invalid seekable zstd stream: too short")
+	}
+	footer, err := readTail(seekFooterSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(footer) != seekFooterSize {
+		return nil, errTruncated
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic {
+		return nil, fmt.Errorf("invalid seekable zstd stream: no seek table")
+	}
+	count := int64(binary.LittleEndian.Uint32(footer))
+	entrySize := int64(8)
+	if footer[4]&seekChecksumFlag != 0 {
+		entrySize += 4
+	}
+	tableSize := skippableHeadSize + count*entrySize + seekFooterSize
+	if tableSize > size {
+		return nil, fmt.Errorf("invalid seekable zstd stream: seek table larger than the stream")
+	}
+
+	table, err := readTail(tableSize)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(table)) != tableSize {
+		return nil, errTruncated
+	}
+	if binary.LittleEndian.Uint32(table) != seekTableMagic ||
+		int64(binary.LittleEndian.Uint32(table[4:])) != tableSize-skippableHeadSize {
+		return nil, fmt.Errorf("invalid seekable zstd stream: bad seek table header")
+	}
+
+	frames := make([]Frame, 0, count)
+	var offset, decompressedOffset int64
+	for entry := table[skippableHeadSize : tableSize-seekFooterSize]; len(entry) > 0; entry = entry[entrySize:] {
+		f := Frame{
+			Offset:             offset,
+			Size:               int64(binary.LittleEndian.Uint32(entry)),
+			DecompressedOffset: decompressedOffset,
+			DecompressedSize:   int64(binary.LittleEndian.Uint32(entry[4:])),
+		}
+		frames = append(frames, f)
+		offset += f.Size
+		decompressedOffset += f.DecompressedSize
+	}
+	if offset+tableSize != size {
+		return nil, fmt.Errorf("invalid seekable zstd stream: frame sizes do not match the stream size")
+	}
+	return frames, nil
+}
+
+func (z *ZstdSeekable) DecodeFrame(src, dst []byte) ([]byte, error) {
+	z.decoderOnce.Do(func() {
+		z.decoder, z.decoderErr = zstd.NewReader(nil)
+	})
+	if z.decoderErr != nil {
+		return nil, z.decoderErr
+	}
+	return z.decoder.DecodeAll(src, dst)
+}
@@ -0,0 +1,79 @@
+package compression
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestZstdSeekable(t *testing.T) {
+	z := &ZstdSeekable{}
+	for _, size := range []int{0, 1, SeekableFrameSize, 2*SeekableFrameSize + 1} {
+		data := make([]byte, size)
+		rand.Read(data[:size/2])
+
+		reader, closeReader := z.WrapRead(bytes.NewReader(data))
+		stream, err := io.ReadAll(reader)
+		closeReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Regular decoders skip the seek table.
+		var decoded bytes.Buffer
+		writer, closeWriter := z.WrapWrite(&decoded)
+		writer.Write(stream)
+		closeWriter()
+		if !bytes.Equal(decoded.Bytes(), data) {
+			t.Fatalf("size %d: sequentially decoded content differs", size)
+		}
+
+		frames, err := z.ReadIndex(int64(len(stream)), func(length int64) ([]byte, error) {
+			return stream[int64(len(stream))-length:], nil
+		})
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if want := (size + SeekableFrameSize - 1) / SeekableFrameSize; len(frames) != want {
+			t.Fatalf("size %d: expected %d frames, got %d", size, want, len(frames))
+		}
+		// Decode frames in reverse order.
+		decodedFrames := make([]byte, size)
+		for i := len(frames) - 1; i >= 0; i-- {
+			f := frames[i]
+			content, err := z.DecodeFrame(stream[f.Offset:f.Offset+f.Size], nil)
+			if err != nil {
+				t.Fatalf("size %d: frame %d: %v", size, i, err)
+			}
+			copy(decodedFrames[f.DecompressedOffset:], content)
+		}
+		if !bytes.Equal(decodedFrames, data) {
+			t.Fatalf("size %d: content decoded by frame differs", size)
+		}
+	}
+}
+
+func TestZstdSeekableTruncated(t *testing.T) {
+	z := &ZstdSeekable{}
+	reader, closeReader := z.WrapRead(bytes.NewReader(make([]byte, 2*SeekableFrameSize)))
+	stream, err := io.ReadAll(reader)
+	closeReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cut := range []int64{seekFooterSize, seekFooterSize + 1} {
+		// Reads shorter than asked, as from a body cut short.
+		_, err := z.ReadIndex(int64(len(stream)), func(length int64) ([]byte, error) {
+			tail := stream[int64(len(stream))-length:]
+			if length >= cut {
+				tail = tail[:cut-1]
+			}
+			return tail, nil
+		})
+		if !errors.Is(err, errTruncated) {
+			t.Fatalf("reads cut to %d bytes: expected a truncated stream, got %v", cut-1, err)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Package encryption implements client-side encryption of stored objects.
+//
+// Objects are encrypted with AES-256-GCM in segments of segmentSize bytes,
+// using a key derived from the master key and a random salt stored in the
+// object header. Segment nonces are a counter with a flag marking the last
+// segment, so that reordered, dropped or truncated segments are detected.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	magic       = "LFSS3E01"
+	saltSize    = 32
+	headerSize  = len(magic) + saltSize
+	segmentSize = 64 * 1024
+	tagSize     = 16
+	// Extension appended to the key of encrypted objects.
+	Extension = ".enc"
+)
+
+var ErrInvalid = errors.New("invalid encrypted object")
+
+// Key is the master key objects are encrypted with.
+type Key struct {
+	master []byte
+}
+
+// KeyFromFile derives a master key from the content of a file, which should
+// hold at least 32 random bytes in any encoding.
+func KeyFromFile(path string) (*Key, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	content = bytes.TrimSpace(content)
+	if len(content) < 32 {
+		return nil, fmt.Errorf("encryption key file %s is too short, it should contain at least 32 bytes", path)
+	}
+	master, err := hkdf.Extract(sha256.New, content, []byte("lfs-s3 key file"))
+	if err != nil {
+		return nil, err
+	}
+	return &Key{master: master}, nil
+}
+
+// KeyFromPassphrase derives a master key from a passphrase.
+func KeyFromPassphrase(passphrase string) (*Key, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("empty encryption passphrase")
+	}
+	master, err := pbkdf2.Key(sha256.New, passphrase, []byte("lfs-s3 passphrase"), 600000, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{master: master}, nil
+}
+
+func (k *Key) aead(salt []byte) (cipher.AEAD, error) {
+	objectKey, err := hkdf.Key(sha256.New, k.master, salt, "lfs-s3 object key", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(objectKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(counter uint64, last bool) []byte {
+	n := make([]byte, 12)
+	if last {
+		n[0] = 1
+	}
+	binary.BigEndian.PutUint64(n[4:], counter)
+	return n
+}
+
+// EncryptedSize returns the size of an encrypted object of size bytes.
+func EncryptedSize(size int64) int64 {
+	segments := size/segmentSize + 1
+	if size > 0 && size%segmentSize == 0 {
+		segments--
+	}
+	return int64(headerSize) + size + segments*tagSize
+}
+
+// Encrypt returns a reader of the encrypted content of source.
+func (k *Key) Encrypt(source io.Reader) (io.Reader, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := k.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(magic), salt...)
+	return &encryptingReader{source: source, aead: aead, out: header}, nil
+}
+
+type encryptingReader struct {
+	source  io.Reader
+	aead    cipher.AEAD
+	counter uint64
+	// Plaintext read ahead, to know whether a segment is the last one.
+	buf  []byte
+	out  []byte
+	done bool
+	err  error
+}
+
+func (er *encryptingReader) Read(p []byte) (int, error) {
+	for len(er.out) == 0 {
+		if er.err != nil {
+			return 0, er.err
+		}
+		if er.done {
+			return 0, io.EOF
+		}
+		er.sealNext()
+	}
+	n := copy(p, er.out)
+	er.out = er.out[n:]
+	return n, nil
+}
+
+// sealNext encrypts the next segment, reading one byte past it to find out
+// whether it is the last one.
+func (er *encryptingReader) sealNext() {
+	if er.buf == nil {
+		er.buf = make([]byte, 0, segmentSize+1)
+	}
+	n, err := io.ReadFull(er.source, er.buf[len(er.buf):segmentSize+1])
+	er.buf = er.buf[:len(er.buf)+n]
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		er.err = err
+		return
+	}
+	last := len(er.buf) <= segmentSize
+	segment := er.buf[:min(len(er.buf), segmentSize)]
+	er.out = er.aead.Seal(er.out[:0], nonce(er.counter, last), segment, nil)
+	er.counter++
+	if last {
+		er.done = true
+		return
+	}
+	er.buf = append(er.buf[:0], er.buf[segmentSize:]...)
+}
+
+// Decrypt returns a writer decrypting what is written to it into dest. Close
+// must be called once everything was written, to check that the object was
+// not truncated.
+func (k *Key) Decrypt(dest io.Writer) io.WriteCloser {
+	return &decryptingWriter{key: k, dest: dest}
+}
+
+type decryptingWriter struct {
+	key     *Key
+	dest    io.Writer
+	aead    cipher.AEAD
+	counter uint64
+	buf     []byte
+	done    bool
+}
+
+func (dw *decryptingWriter) Write(p []byte) (int, error) {
+	dw.buf = append(dw.buf, p...)
+	if dw.aead == nil {
+		if len(dw.buf) < headerSize {
+			return len(p), nil
+		}
+		if string(dw.buf[:len(magic)]) != magic {
+			return 0, fmt.Errorf("%w: bad header", ErrInvalid)
+		}
+		aead, err := dw.key.aead(dw.buf[len(magic):headerSize])
+		if err != nil {
+			return 0, err
+		}
+		dw.aead = aead
+		dw.buf = dw.buf[headerSize:]
+	}
+	// Keep at least one full segment buffered, as it may be the last one.
+	for len(dw.buf) > segmentSize+tagSize {
+		if err := dw.open(dw.buf[:segmentSize+tagSize], false); err != nil {
+			return 0, err
+		}
+		dw.buf = dw.buf[segmentSize+tagSize:]
+	}
+	return len(p), nil
+}
+
+func (dw *decryptingWriter) open(segment []byte, last bool) error {
+	if dw.done {
+		return fmt.Errorf("%w: data after the last segment", ErrInvalid)
+	}
+	plaintext, err := dw.aead.Open(nil, nonce(dw.counter, last), segment, nil)
+	if err != nil {
+		return fmt.Errorf("%w: segment %d: %v", ErrInvalid, dw.counter, err)
+	}
+	dw.counter++
+	dw.done = last
+	_, err = dw.dest.Write(plaintext)
+	return err
+}
+
+func (dw *decryptingWriter) Close() error {
+	if dw.aead == nil {
+		return fmt.Errorf("%w: truncated header", ErrInvalid)
+	}
+	if err := dw.open(dw.buf, true); err != nil {
+		return err
+	}
+	dw.buf = nil
+	return nil
+}
@@ -0,0 +1,93 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func encrypt(t *testing.T, key *Key, plaintext []byte) []byte {
+	t.Helper()
+	r, err := key.Encrypt(bytes.NewReader(plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+func decrypt(key *Key, ciphertext []byte) ([]byte, error) {
+	var plaintext bytes.Buffer
+	w := key.Decrypt(&plaintext)
+	// Write in odd-sized chunks, as downloads do.
+	for len(ciphertext) > 0 {
+		n := min(len(ciphertext), 1000)
+		if _, err := w.Write(ciphertext[:n]); err != nil {
+			return nil, err
+		}
+		ciphertext = ciphertext[n:]
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return plaintext.Bytes(), nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	key, err := KeyFromPassphrase("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3*segmentSize + 17} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		ciphertext := encrypt(t, key, plaintext)
+		if int64(len(ciphertext)) != EncryptedSize(int64(size)) {
+			t.Errorf("size %d: encrypted size is %d, expected %d", size, len(ciphertext), EncryptedSize(int64(size)))
+		}
+		got, err := decrypt(key, ciphertext)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("size %d: decrypted content differs", size)
+		}
+	}
+}
+
+func TestTampering(t *testing.T) {
+	key, err := KeyFromPassphrase("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := KeyFromPassphrase("incorrect horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, 2*segmentSize+5)
+	ciphertext := encrypt(t, key, plaintext)
+
+	flipped := bytes.Clone(ciphertext)
+	flipped[headerSize+10] ^= 1
+	cases := map[string]struct {
+		key        *Key
+		ciphertext []byte
+	}{
+		"wrong key":      {other, ciphertext},
+		"modified":       {key, flipped},
+		"truncated":      {key, ciphertext[:headerSize+2*(segmentSize+tagSize)]},
+		"extended":       {key, append(bytes.Clone(ciphertext), 0)},
+		"header only":    {key, ciphertext[:headerSize]},
+		"missing header": {key, ciphertext[:10]},
+	}
+	for name, c := range cases {
+		if _, err := decrypt(c.key, c.ciphertext); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: expected an invalid object error, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Package fsadapter stores LFS objects in a local or network-mounted directory.
+//
+// Objects are laid out exactly as in an S3 bucket, so that a directory can be
+// synchronized with a bucket using regular S3 tools. Object metadata is stored
+// in a hidden JSON file next to each object.
+package fsadapter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/nicolas-graves/lfs-s3/backend"
+)
+
+const (
+	// Prefix of the files being written, which are not listed as objects.
+	tempPrefix = ".lfs-s3-tmp-"
+	// Suffix of the hidden metadata files, which are not listed as objects.
+	metadataSuffix = ".meta"
+)
+
+type Config struct {
+	RootPath string
+}
+
+// Storage is a backend.Backend storing objects as files under a root directory.
+type Storage struct {
+	config *Config
+}
+
+var _ backend.Backend = (*Storage)(nil)
+
+func New(config *Config) (*Storage, error) {
+	if config.RootPath == "" {
+		return nil, fmt.Errorf("no root path set")
+	}
+	if err := os.MkdirAll(config.RootPath, 0755); err != nil {
+		return nil, err
+	}
+	return &Storage{config: config}, nil
+}
+
+func (s *Storage) path(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(s.config.RootPath, filepath.FromSlash(key)), nil
+}
+
+func metadataPath(p string) string {
+	return filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+metadataSuffix)
+}
+
+// asBackendError converts "not exist" errors to backend.ErrNotFound.
+func asBackendError(key string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", backend.ErrNotFound, key)
+	}
+	return err
+}
+
+func (s *Storage) Stat(ctx context.Context, key string) (*backend.ObjectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, asBackendError(key, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: %s", backend.ErrNotFound, key)
+	}
+	var metadata map[string]string
+	if content, err := os.ReadFile(metadataPath(p)); err == nil {
+		if err := json.Unmarshal(content, &metadata); err != nil {
+			return nil, fmt.Errorf("invalid metadata for %s: %v", key, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return &backend.ObjectInfo{Key: key, Size: fi.Size(), ETag: etag(fi), Metadata: metadata}, nil
+}
+
+// etag identifies the content of a file. As files are replaced atomically,
+// their size and modification time are enough.
+func etag(fi fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+// Put writes the object to a temporary file in the destination directory and
+// renames it into place, so that readers never see partially written objects.
+// Metadata is written first, so that it is in place once the object is.
+func (s *Storage) Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if len(metadata) == 0 {
+		if err := os.Remove(metadataPath(p)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	} else {
+		content, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(ctx, metadataPath(p), bytes.NewReader(content)); err != nil {
+			return err
+		}
+	}
+	return writeFile(ctx, p, body)
+}
+
+// writeFile atomically writes the content of body to p.
+func writeFile(ctx context.Context, p string, body io.Reader) error {
+	file, err := os.CreateTemp(filepath.Dir(p), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	if _, err := io.Copy(file, &contextReader{ctx: ctx, r: body}); err != nil {
+		return err
+	}
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), p)
+}
+
+func (s *Storage) Get(ctx context.Context, key string, dest io.Writer) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return asBackendError(key, err)
+	}
+	defer file.Close()
+	_, err = io.Copy(dest, &contextReader{ctx: ctx, r: file})
+	return err
+}
+
+func (s *Storage) GetRange(ctx context.Context, key string, offset, length int64, expectedETag string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, asBackendError(key, err)
+	}
+	if expectedETag != "" {
+		fi, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if etag(fi) != expectedETag {
+			file.Close()
+			return nil, fmt.Errorf("%w: %s", backend.ErrChanged, key)
+		}
+	}
+	return &sectionReadCloser{
+		SectionReader: io.NewSectionReader(file, offset, length),
+		file:          file,
+	}, nil
+}
+
+type sectionReadCloser struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (src *sectionReadCloser) Close() error {
+	return src.file.Close()
+}
+
+func (s *Storage) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil {
+		return asBackendError(key, err)
+	}
+	if err := os.Remove(metadataPath(p)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// contextReader stops reading once its context is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (n int, err error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -7,6 +7,8 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.99.1
 	github.com/aws/smithy-go v1.25.0
 	github.com/klauspost/compress v1.18.5
+	github.com/pierrec/lz4/v4 v4.1.31
+	github.com/ulikunitz/xz v0.5.17
 )
 
 require (
@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestContextAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := NewHandler(&buf, "json", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := NewContext(context.Background(), slog.New(h))
+	ctx = With(ctx, "oid", "abc")
+	FromContext(ctx).Debug("hidden")
+	FromContext(ctx).Info("shown", "size", 42)
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON record, got %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "shown" || record["oid"] != "abc" || record["size"] != float64(42) {
+		t.Fatalf("unexpected record: %v", record)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := NewHandler(&bytes.Buffer{}, "xml", slog.LevelInfo); err == nil {
+		t.Fatalf("unknown format was accepted")
+	}
+}
+
+func TestFromContextDefault(t *testing.T) {
+	if FromContext(context.Background()) != slog.Default() {
+		t.Fatalf("expected the default logger")
+	}
+}
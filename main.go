@@ -1,34 +1,69 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/nicolas-graves/lfs-s3/backend"
 	"github.com/nicolas-graves/lfs-s3/compression"
+	"github.com/nicolas-graves/lfs-s3/encryption"
+	"github.com/nicolas-graves/lfs-s3/fsadapter"
+	"github.com/nicolas-graves/lfs-s3/logging"
 	"github.com/nicolas-graves/lfs-s3/s3adapter"
 	"github.com/nicolas-graves/lfs-s3/service"
 )
 
-var config s3adapter.Config
+var config service.Config
+var s3Config s3adapter.Config
+var backendName string
+var rootPath string
 var comp string
+var compressionRules string
+var encryptionKeyFile string
+var encryptionPassphrase string
+var logLevel slog.Level
+var logFormat string
+var logFile string
 
 func init() {
-	flag.StringVar(&config.AccessKeyId, "access_key_id", "", "S3 Access Key ID")
-	flag.StringVar(&config.SecretAccessKey, "secret_access_key", "", "S3 Secret Access Key")
-	flag.StringVar(&config.Bucket, "bucket", "", "S3 Bucket")
-	flag.StringVar(&config.Endpoint, "endpoint", "", "S3 Endpoint")
-	flag.StringVar(&config.Region, "region", "", "S3 Region")
-	flag.StringVar(&config.RootPath, "root_path", "", "Path within the bucket under which LFS files are uploaded. Can be empty.")
-	flag.BoolVar(&config.UsePathStyle, "use_path_style", false, "Whether to use path-style URLs for S3.")
+	flag.StringVar(&backendName, "backend", "s3", "Storage backend to use. Possible values: s3, file")
+	flag.StringVar(&s3Config.AccessKeyId, "access_key_id", "", "S3 Access Key ID")
+	flag.StringVar(&s3Config.SecretAccessKey, "secret_access_key", "", "S3 Secret Access Key")
+	flag.StringVar(&s3Config.Bucket, "bucket", "", "S3 Bucket")
+	flag.StringVar(&s3Config.Endpoint, "endpoint", "", "S3 Endpoint")
+	flag.StringVar(&s3Config.Region, "region", "", "S3 Region")
+	flag.StringVar(&rootPath, "root_path", "", "Path within the bucket under which LFS files are uploaded. Can be empty. With the file backend, directory in which LFS files are stored.")
+	flag.BoolVar(&s3Config.UsePathStyle, "use_path_style", false, "Whether to use path-style URLs for S3.")
+	flag.StringVar(&s3Config.ServerSideEncryption, "sse", "", "S3 server-side encryption. Possible values: AES256, aws:kms, aws:kms:dsse. Can be empty.")
+	flag.StringVar(&s3Config.SSEKMSKeyId, "sse_kms_key_id", "", "KMS key ID for aws:kms server-side encryption. Can be empty.")
+	flag.StringVar(&s3Config.SSECustomerKey, "sse_customer_key", "", "Base64-encoded 256-bit key for S3 server-side encryption with customer-provided keys (SSE-C). Can be empty.")
+	flag.IntVar(&config.DownloadConcurrency, "download_concurrency", 4, "Number of concurrent requests used to download each uncompressed or zstd-seekable file.")
+	flag.IntVar(&s3Config.MaxAttempts, "max_attempts", 3, "Maximum number of attempts of each S3 request, retrying transient errors.")
+	flag.DurationVar(&s3Config.MaxBackoff, "max_backoff", 20*time.Second, "Maximum delay between attempts of an S3 request.")
+	flag.DurationVar(&s3Config.PartTimeout, "part_timeout", 0, "Timeout of each attempt of an S3 request, which transfers at most one part of a file. 0 for none.")
+	flag.DurationVar(&config.TransferTimeout, "transfer_timeout", 0, "Deadline for transferring each file, including retries. 0 for none.")
+	flag.StringVar(&compressionRules, "compression_rules", "", "File of rules choosing the compression of files by path, overriding --compression. Only applies to files in the checked-out commit. Can be empty.")
+	flag.Float64Var(&config.MinCompressionRatio, "min_compression_ratio", 0, "Files whose compression ratio, estimated on their first MB, is lower are stored uncompressed (e.g. 1.1). 0 to always compress them.")
 	flag.BoolVar(&config.DeleteOtherVersions, "delete_other_versions", true, "Whether to delete other (e.g. uploaded using different compression methods) versions of the stored file after upload.")
 
+	flag.StringVar(&encryptionKeyFile, "encryption_key_file", "", "File containing the key to encrypt files with before storing them. Can be empty.")
+	flag.StringVar(&encryptionPassphrase, "encryption_passphrase", "", "Passphrase to encrypt files with before storing them. Can be empty.")
+
+	flag.TextVar(&logLevel, "log_level", slog.LevelInfo, "Minimum level of logged messages. Possible values: debug, info, warn, error.")
+	flag.StringVar(&logFormat, "log_format", logging.Formats[0], "Format of logs. Possible values: "+strings.Join(logging.Formats, ", "))
+	flag.StringVar(&logFile, "log_file", "", "File to append logs to, instead of stderr. Can be empty.")
+
 	var compressions []string
-	for _, c := range compression.Compressions {
+	for _, c := range compression.Registered() {
 		compressions = append(compressions, c.Name())
 	}
-	flag.StringVar(&comp, "compression", compression.Compressions[0].Name(), "Compression to use for storing files. Possible values: "+
+	flag.StringVar(&comp, "compression", compression.Default().Name(), "Compression to use for storing files, optionally with options (e.g. zstd:3). Possible values: "+
 		strings.Join(compressions, ", "))
 }
 
@@ -38,25 +73,78 @@ func tryFromEnv(setting *string, key string) {
 	}
 }
 
-func run() error {
-	for _, c := range compression.Compressions {
-		if c.Name() == comp {
-			config.Compression = c
-			break
+// configure completes the configuration from the flags.
+func configure() error {
+	var err error
+	if config.Compression, err = compression.Parse(comp); err != nil {
+		return err
+	}
+	if compressionRules != "" {
+		if config.CompressionRules, err = service.LoadRules(compressionRules); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case encryptionKeyFile != "" && encryptionPassphrase != "":
+		return fmt.Errorf("encryption key file and passphrase cannot both be set")
+	case encryptionKeyFile != "":
+		if config.Encryption, err = encryption.KeyFromFile(encryptionKeyFile); err != nil {
+			return err
+		}
+	case encryptionPassphrase != "":
+		if config.Encryption, err = encryption.KeyFromPassphrase(encryptionPassphrase); err != nil {
+			return err
 		}
 	}
 
 	// For backwards-compatibility, also allow using env variables.
-	tryFromEnv(&config.Bucket, "S3_BUCKET")
-	tryFromEnv(&config.Region, "AWS_REGION")
-	tryFromEnv(&config.Endpoint, "AWS_S3_ENDPOINT")
+	tryFromEnv(&s3Config.Bucket, "S3_BUCKET")
+	tryFromEnv(&s3Config.Region, "AWS_REGION")
+	tryFromEnv(&s3Config.Endpoint, "AWS_S3_ENDPOINT")
+	return nil
+}
 
-	return service.Serve(os.Stdin, os.Stdout, os.Stderr, &config)
+// open is run on init, so that configuration errors are reported to git-lfs.
+func open(ctx context.Context) (backend.Backend, error) {
+	if err := configure(); err != nil {
+		return nil, err
+	}
+	switch backendName {
+	case "s3":
+		s3Config.RootPath = rootPath
+		return s3adapter.Open(ctx, &s3Config)
+	case "file":
+		return fsadapter.New(&fsadapter.Config{RootPath: rootPath})
+	default:
+		return nil, fmt.Errorf("unknown backend %s", backendName)
+	}
+}
+
+// setupLogging sets the default logger up according to the flags.
+func setupLogging() error {
+	w := os.Stderr
+	if logFile != "" {
+		var err error
+		if w, err = os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			return err
+		}
+	}
+	h, err := logging.NewHandler(w, logFormat, logLevel)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
 }
 
 func main() {
 	flag.Parse()
-	if err := run(); err != nil {
+	if err := setupLogging(); err != nil {
 		log.Fatal(err)
 	}
+	if err := service.Serve(os.Stdin, os.Stdout, open, &config); err != nil {
+		slog.Error("Fatal error", "error", err)
+		os.Exit(1)
+	}
 }
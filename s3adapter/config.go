@@ -2,21 +2,36 @@ package s3adapter
 
 import (
 	"context"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/nicolas-graves/lfs-s3/compression"
 )
 
 type Config struct {
-	AccessKeyId         string
-	SecretAccessKey     string
-	Bucket              string
-	Endpoint            string
-	Region              string
-	RootPath            string
-	UsePathStyle        bool
-	Compression         compression.Compression
-	DeleteOtherVersions bool
+	AccessKeyId     string
+	SecretAccessKey string
+	Bucket          string
+	Endpoint        string
+	Region          string
+	RootPath        string
+	UsePathStyle    bool
+	// Server-side encryption of stored objects: "AES256" (SSE-S3), "aws:kms" or
+	// "aws:kms:dsse" (SSE-KMS). Empty to use the bucket default.
+	ServerSideEncryption string
+	// KMS key to encrypt objects with when using SSE-KMS. Empty to use the
+	// AWS managed key.
+	SSEKMSKeyId string
+	// Base64-encoded 256-bit key to encrypt objects with (SSE-C). Empty to not
+	// use SSE-C.
+	SSECustomerKey string
+	// Maximum number of attempts of each request, including the first one.
+	// 0 to use the SDK default.
+	MaxAttempts int
+	// Maximum delay between attempts of a request. 0 to use the SDK default.
+	MaxBackoff time.Duration
+	// Timeout of each attempt of a request, which transfers at most one part
+	// of an object. 0 for none.
+	PartTimeout time.Duration
 }
 
 func (config *Config) Retrieve(context.Context) (aws.Credentials, error) {
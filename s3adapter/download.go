@@ -4,13 +4,10 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
-	"os"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/nicolas-graves/lfs-s3/compression"
 )
 
 type writerAtWrapper struct {
@@ -26,64 +23,35 @@ func (waw *writerAtWrapper) WriteAt(p []byte, off int64) (n int, err error) {
 	return waw.w.Write(p)
 }
 
-type downloadTracker struct {
-	writer   io.WriterAt
-	callback func(transferred int64)
-}
-
-func (dt *downloadTracker) WriteAt(p []byte, off int64) (n int, err error) {
-	n, err = dt.writer.WriteAt(p, off)
-	if n > 0 {
-		dt.callback(int64(n))
-	}
-	return
-}
-
-func (conn *Connection) Download(oid string, localPath string, callback func(transferred int64)) error {
-	log.Printf("Received download request for %s", oid)
-	file, err := os.Create(localPath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	var comp compression.Compression
-	basePath := conn.asLfsPath(oid)
-
-	for _, c := range compression.Compressions {
-		compPath := basePath + c.Extension()
-		log.Printf("Checking %s", compPath)
-		if conn.fileExists(compPath) {
-			comp = c
-			basePath = compPath
-			break
-		}
-	}
-
-	if comp == nil {
-		return fmt.Errorf("No downloadable version of the file was found")
-	}
-
-	log.Printf("Resolved remote path: %s with compression %s", basePath, comp.Name())
-
-	writer, closeWriter := comp.WrapWrite(file)
-	defer closeWriter()
-	dt := &downloadTracker{
-		writer:   &writerAtWrapper{w: writer},
-		callback: callback,
-	}
-
+func (conn *Connection) Get(ctx context.Context, key string, dest io.Writer) error {
 	downloader := manager.NewDownloader(conn.client, func(d *manager.Downloader) {
 		d.PartSize = partSize
 		d.Concurrency = 1
 	})
-	if _, err := downloader.Download(context.Background(), dt, &s3.GetObjectInput{
+	_, err := downloader.Download(ctx, &writerAtWrapper{w: dest}, &s3.GetObjectInput{
 		Bucket: aws.String(conn.config.Bucket),
-		Key:    aws.String(basePath),
-	}); err != nil {
-		return err
-	}
+		Key:    aws.String(conn.asLfsPath(key)),
+
+		SSECustomerAlgorithm: conn.sseC.algorithm,
+		SSECustomerKey:       conn.sseC.key,
+		SSECustomerKeyMD5:    conn.sseC.keyMD5,
+	})
+	return asBackendError(key, err)
+}
+
+func (conn *Connection) GetRange(ctx context.Context, key string, offset, length int64, etag string) (io.ReadCloser, error) {
+	out, err := conn.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:  aws.String(conn.config.Bucket),
+		Key:     aws.String(conn.asLfsPath(key)),
+		Range:   aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+		IfMatch: nilIfEmpty(etag),
 
-	log.Printf("Download of %s finished, returning", basePath)
-	return nil
+		SSECustomerAlgorithm: conn.sseC.algorithm,
+		SSECustomerKey:       conn.sseC.key,
+		SSECustomerKeyMD5:    conn.sseC.keyMD5,
+	})
+	if err != nil {
+		return nil, asBackendError(key, err)
+	}
+	return out.Body, nil
 }
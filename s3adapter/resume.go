@@ -0,0 +1,350 @@
+package s3adapter
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/nicolas-graves/lfs-s3/backend"
+	"github.com/nicolas-graves/lfs-s3/logging"
+)
+
+// uploadState records a multipart upload in progress, so that an interrupted
+// upload of the same key is resumed instead of started over.
+type uploadState struct {
+	Key      string `json:"key"`
+	UploadID string `json:"upload_id"`
+	PartSize int64  `json:"part_size"`
+	// Server-side encryption settings the upload was created with, which its
+	// parts must be uploaded with too.
+	SSE   string                 `json:"sse"`
+	Parts map[int32]uploadedPart `json:"parts"`
+}
+
+type uploadedPart struct {
+	Size          int64  `json:"size"`
+	ETag          string `json:"etag"`
+	ChecksumCRC32 string `json:"checksum_crc32,omitempty"`
+	// SHA-256 of the content of the part, to check that the content being
+	// uploaded is still the same when resuming.
+	SHA256 string `json:"sha256"`
+}
+
+// Interrupted uploads whose state was not updated for longer are aborted, so
+// that their parts are not stored, and billed, forever when the push is not
+// retried.
+const staleUploadAge = 7 * 24 * time.Hour
+
+// SetStateDir makes multipart uploads resumable, keeping track of them in dir,
+// and aborts the uploads in dir which are stale.
+func (conn *Connection) SetStateDir(ctx context.Context, dir string) {
+	conn.stateDir = dir
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logging.FromContext(ctx).Warn("Error reading upload states", "path", dir, "error", err)
+		}
+		return
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() && filepath.Ext(e.Name()) == ".json" {
+			if fi, err := e.Info(); err == nil && time.Since(fi.ModTime()) > staleUploadAge {
+				conn.discardUpload(ctx, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+}
+
+// DiscardUpload aborts the interrupted multipart upload of key, if any.
+func (conn *Connection) DiscardUpload(ctx context.Context, key string) {
+	if conn.stateDir != "" {
+		conn.discardUpload(ctx, conn.statePath(conn.asLfsPath(key)))
+	}
+}
+
+// discardUpload aborts the multipart upload recorded in the state file at
+// path and removes the file. The file is kept if aborting fails, to try again
+// later.
+func (conn *Connection) discardUpload(ctx context.Context, path string) {
+	state, err := loadUploadState(ctx, path)
+	if err != nil {
+		return
+	}
+	if state != nil {
+		err := conn.abortUpload(ctx, state.Key, state.UploadID)
+		if err != nil && !errors.Is(asBackendError(state.Key, err), backend.ErrNotFound) {
+			return
+		}
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logging.FromContext(ctx).Warn("Error removing upload state", "path", path, "error", err)
+	}
+}
+
+func (conn *Connection) statePath(remotePath string) string {
+	sum := sha256.Sum256([]byte(conn.config.Bucket + "/" + remotePath))
+	return filepath.Join(conn.stateDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// sseSettings identifies the server-side encryption settings of the connection.
+func (conn *Connection) sseSettings() string {
+	return strings.Join([]string{
+		conn.config.ServerSideEncryption,
+		conn.config.SSEKMSKeyId,
+		aws.ToString(conn.sseC.keyMD5),
+	}, "/")
+}
+
+func loadUploadState(ctx context.Context, path string) (*uploadState, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state uploadState
+	if err := json.Unmarshal(content, &state); err != nil || state.Parts == nil {
+		logging.FromContext(ctx).Warn("Ignoring invalid upload state", "path", path, "error", err)
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func (state *uploadState) save(path string) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// resumeUpload returns the state of an interrupted upload of remotePath which
+// can be resumed, keeping only the parts which are still stored, or nil.
+func (conn *Connection) resumeUpload(ctx context.Context, path string, remotePath string) (*uploadState, error) {
+	state, err := loadUploadState(ctx, path)
+	if err != nil || state == nil {
+		return nil, err
+	}
+	if state.Key != remotePath || state.PartSize != partSize || state.SSE != conn.sseSettings() {
+		logging.FromContext(ctx).Info("Upload settings changed, not resuming multipart upload", "upload_id", state.UploadID)
+		conn.abortUpload(ctx, state.Key, state.UploadID)
+		return nil, os.Remove(path)
+	}
+
+	stored := map[int32]types.Part{}
+	paginator := s3.NewListPartsPaginator(conn.client, &s3.ListPartsInput{
+		Bucket:   aws.String(conn.config.Bucket),
+		Key:      aws.String(remotePath),
+		UploadId: aws.String(state.UploadID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if errors.Is(asBackendError(remotePath, err), backend.ErrNotFound) {
+			logging.FromContext(ctx).Info("Multipart upload no longer exists, starting over", "upload_id", state.UploadID)
+			return nil, os.Remove(path)
+		} else if err != nil {
+			return nil, err
+		}
+		for _, p := range page.Parts {
+			stored[aws.ToInt32(p.PartNumber)] = p
+		}
+	}
+	for number, p := range state.Parts {
+		s, ok := stored[number]
+		if !ok || aws.ToString(s.ETag) != p.ETag || aws.ToInt64(s.Size) != p.Size {
+			delete(state.Parts, number)
+		}
+	}
+	return state, nil
+}
+
+// putResumable uploads an object in multiple parts, recording the progress of
+// the upload so that it can be resumed if it is interrupted: failed uploads
+// are left in progress rather than aborted, until they are resumed, no longer
+// needed or stale.
+func (conn *Connection) putResumable(ctx context.Context, remotePath string, body io.Reader, metadata map[string]string) error {
+	path := conn.statePath(remotePath)
+	state, err := conn.resumeUpload(ctx, path, remotePath)
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		logging.FromContext(ctx).Info("Resuming multipart upload", "upload_id", state.UploadID, "parts_uploaded", len(state.Parts))
+	} else {
+		out, err := conn.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:            aws.String(conn.config.Bucket),
+			Key:               aws.String(remotePath),
+			Metadata:          metadata,
+			ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
+
+			ServerSideEncryption: types.ServerSideEncryption(conn.config.ServerSideEncryption),
+			SSEKMSKeyId:          nilIfEmpty(conn.config.SSEKMSKeyId),
+			SSECustomerAlgorithm: conn.sseC.algorithm,
+			SSECustomerKey:       conn.sseC.key,
+			SSECustomerKeyMD5:    conn.sseC.keyMD5,
+		})
+		if err != nil {
+			return err
+		}
+		state = &uploadState{
+			Key:      remotePath,
+			UploadID: aws.ToString(out.UploadId),
+			PartSize: partSize,
+			SSE:      conn.sseSettings(),
+			Parts:    map[int32]uploadedPart{},
+		}
+		if err := state.save(path); err != nil {
+			conn.abortUpload(ctx, remotePath, state.UploadID)
+			return err
+		}
+	}
+
+	parts, err := conn.uploadParts(ctx, state, path, body)
+	if err != nil {
+		logging.FromContext(ctx).Warn("Multipart upload interrupted, it will be resumed on the next attempt", "upload_id", state.UploadID)
+		return err
+	}
+	if _, err := conn.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(conn.config.Bucket),
+		Key:             aws.String(remotePath),
+		UploadId:        aws.String(state.UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+
+		SSECustomerAlgorithm: conn.sseC.algorithm,
+		SSECustomerKey:       conn.sseC.key,
+		SSECustomerKeyMD5:    conn.sseC.keyMD5,
+	}); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		logging.FromContext(ctx).Warn("Error removing upload state", "error", err)
+	}
+	return nil
+}
+
+// uploadParts uploads the parts of body which are not already stored, with
+// concurrent requests, and returns the list of all the parts of the upload.
+func (conn *Connection) uploadParts(ctx context.Context, state *uploadState, path string, body io.Reader) ([]types.CompletedPart, error) {
+	// A failure stops reading body, but lets the parts being uploaded finish,
+	// as they are useful to resume the upload.
+	stop, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	type chunk struct {
+		number int32
+		data   []byte
+	}
+	chunks := make(chan chunk)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < manager.DefaultUploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				if err := conn.uploadPart(ctx, state, path, &mu, c.number, c.data); err != nil {
+					cancel(err)
+				}
+			}
+		}()
+	}
+
+	var number int32
+	for stop.Err() == nil {
+		data := make([]byte, partSize)
+		n, err := io.ReadFull(body, data)
+		if n > 0 {
+			if number++; number > manager.MaxUploadParts {
+				cancel(fmt.Errorf("object exceeds the maximum of %d parts", manager.MaxUploadParts))
+				break
+			}
+			select {
+			case chunks <- chunk{number, data[:n]}:
+			case <-stop.Done():
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			cancel(err)
+		}
+	}
+	close(chunks)
+	wg.Wait()
+	if err := context.Cause(stop); err != nil {
+		return nil, err
+	}
+
+	parts := make([]types.CompletedPart, number)
+	for i := range parts {
+		p := state.Parts[int32(i+1)]
+		parts[i] = types.CompletedPart{
+			PartNumber:    aws.Int32(int32(i + 1)),
+			ETag:          aws.String(p.ETag),
+			ChecksumCRC32: nilIfEmpty(p.ChecksumCRC32),
+		}
+	}
+	return parts, nil
+}
+
+// uploadPart uploads a part unless it is already stored with the same
+// content, and records it in the upload state. The state is guarded by mu.
+func (conn *Connection) uploadPart(ctx context.Context, state *uploadState, path string, mu *sync.Mutex, number int32, data []byte) error {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	mu.Lock()
+	stored, ok := state.Parts[number]
+	mu.Unlock()
+	if ok && stored.SHA256 == digest && stored.Size == int64(len(data)) {
+		logging.FromContext(ctx).Debug("Part already uploaded, skipping it", "part", number)
+		return nil
+	}
+
+	out, err := conn.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:            aws.String(conn.config.Bucket),
+		Key:               aws.String(state.Key),
+		UploadId:          aws.String(state.UploadID),
+		PartNumber:        aws.Int32(number),
+		Body:              bytes.NewReader(data),
+		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
+
+		SSECustomerAlgorithm: conn.sseC.algorithm,
+		SSECustomerKey:       conn.sseC.key,
+		SSECustomerKeyMD5:    conn.sseC.keyMD5,
+	})
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	state.Parts[number] = uploadedPart{
+		Size:          int64(len(data)),
+		ETag:          aws.ToString(out.ETag),
+		ChecksumCRC32: aws.ToString(out.ChecksumCRC32),
+		SHA256:        digest,
+	}
+	return state.save(path)
+}
@@ -0,0 +1,39 @@
+package s3adapter
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+// loggingRetryer logs every retry of a request along with its cause.
+type loggingRetryer struct {
+	aws.RetryerV2
+}
+
+func (r loggingRetryer) RetryDelay(attempt int, err error) (time.Duration, error) {
+	delay, delayErr := r.RetryerV2.RetryDelay(attempt, err)
+	if delayErr == nil {
+		slog.Warn("Retrying S3 request", "attempt", attempt, "delay", delay, "error", err)
+	}
+	return delay, delayErr
+}
+
+// newRetryer returns the standard SDK retryer with the configured attempts and
+// backoff. Retries are not rate limited: a client-side retry quota would fail
+// transfers precisely when a flaky endpoint needs them most.
+func newRetryer(conf *Config) aws.Retryer {
+	return loggingRetryer{retry.NewStandard(func(o *retry.StandardOptions) {
+		if conf.MaxAttempts > 0 {
+			o.MaxAttempts = conf.MaxAttempts
+		}
+		if conf.MaxBackoff > 0 {
+			o.MaxBackoff = conf.MaxBackoff
+			o.Backoff = retry.NewExponentialJitterBackoff(conf.MaxBackoff)
+		}
+		o.RateLimiter = ratelimit.None
+	})}
+}
@@ -2,22 +2,40 @@ package s3adapter
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/nicolas-graves/lfs-s3/backend"
+	"github.com/nicolas-graves/lfs-s3/logging"
 )
 
 const partSize = 5 * 1024 * 1024 // Size of transferred parts, in bytes.
 
+// Connection is a backend.Backend storing objects in an S3 bucket.
 type Connection struct {
 	client *s3.Client
 	config *Config
+	sseC   sseCustomer
+	// Directory the state of multipart uploads is kept in, so that they can
+	// be resumed. Empty if uploads are not resumable.
+	stateDir string
 }
 
+var _ backend.Lister = (*Connection)(nil)
+
+var (
+	_ backend.Backend   = (*Connection)(nil)
+	_ backend.Resumable = (*Connection)(nil)
+)
+
 func (conn *Connection) asLfsPath(path string) string {
 	root := conn.config.RootPath
 	if root == "" {
@@ -27,21 +45,78 @@ func (conn *Connection) asLfsPath(path string) string {
 	}
 }
 
-func (conn *Connection) fileExists(path string) bool {
-	ho, err := conn.client.HeadObject(context.Background(), &s3.HeadObjectInput{
-		Bucket: aws.String(conn.config.Bucket),
-		Key:    aws.String(path),
+// asBackendError converts "not found", "forbidden" and "precondition failed"
+// responses to backend.ErrNotFound, backend.ErrAccessDenied and
+// backend.ErrChanged.
+func asBackendError(key string, err error) error {
+	var re *awshttp.ResponseError
+	if errors.As(err, &re) {
+		switch re.HTTPStatusCode() {
+		case http.StatusForbidden:
+			return fmt.Errorf("%w: %s: %w", backend.ErrAccessDenied, key, err)
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: %s", backend.ErrNotFound, key)
+		case http.StatusPreconditionFailed:
+			return fmt.Errorf("%w: %s", backend.ErrChanged, key)
+		}
+	}
+	return err
+}
+
+func (conn *Connection) Stat(ctx context.Context, key string) (*backend.ObjectInfo, error) {
+	ho, err := conn.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(conn.config.Bucket),
+		Key:          aws.String(conn.asLfsPath(key)),
+		ChecksumMode: types.ChecksumModeEnabled,
+
+		SSECustomerAlgorithm: conn.sseC.algorithm,
+		SSECustomerKey:       conn.sseC.key,
+		SSECustomerKeyMD5:    conn.sseC.keyMD5,
 	})
 	if err != nil {
-		return false
-	}
-	if ho == nil {
-		return false
+		return nil, asBackendError(key, err)
 	}
 	if ho.ContentLength == nil {
-		return false
+		return nil, fmt.Errorf("%w: %s", backend.ErrNotFound, key)
 	}
-	return true
+	return &backend.ObjectInfo{
+		Key:            key,
+		Size:           *ho.ContentLength,
+		ETag:           aws.ToString(ho.ETag),
+		ChecksumCRC32C: aws.ToString(ho.ChecksumCRC32C),
+		Metadata:       ho.Metadata,
+	}, nil
+}
+
+func (conn *Connection) Delete(ctx context.Context, key string) error {
+	_, err := conn.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(conn.config.Bucket),
+		Key:    aws.String(conn.asLfsPath(key)),
+	})
+	return err
+}
+
+func (conn *Connection) List(ctx context.Context, prefix string) ([]backend.ObjectInfo, error) {
+	root := conn.asLfsPath("")
+	var objects []backend.ObjectInfo
+	paginator := s3.NewListObjectsV2Paginator(conn.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(conn.config.Bucket),
+		Prefix: aws.String(conn.asLfsPath(prefix)),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, asBackendError(prefix, err)
+		}
+		for _, o := range page.Contents {
+			objects = append(objects, backend.ObjectInfo{
+				Key:  strings.TrimPrefix(aws.ToString(o.Key), root),
+				Size: aws.ToInt64(o.Size),
+				ETag: aws.ToString(o.ETag),
+			})
+		}
+	}
+	return objects, nil
 }
 
 func createS3Client(conf *Config) (*s3.Client, error) {
@@ -55,6 +130,10 @@ func createS3Client(conf *Config) (*s3.Client, error) {
 	cfg.Region = conf.Region
 
 	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.Retryer = newRetryer(conf)
+		if conf.PartTimeout > 0 {
+			o.HTTPClient = awshttp.NewBuildableClient().WithTimeout(conf.PartTimeout)
+		}
 		if conf.AccessKeyId != "" {
 			o.Credentials = conf
 		}
@@ -68,6 +147,26 @@ func createS3Client(conf *Config) (*s3.Client, error) {
 }
 
 func New(config *Config) (*Connection, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("no bucket set")
+	}
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("no endpoint set")
+	}
+	if (config.AccessKeyId == "") != (config.SecretAccessKey == "") {
+		return nil, fmt.Errorf("access key and secret key should either both be set or both be empty")
+	}
+	if config.MaxAttempts < 0 || config.MaxBackoff < 0 || config.PartTimeout < 0 {
+		return nil, fmt.Errorf("retry attempts, backoff and timeout cannot be negative")
+	}
+	if err := validateSSE(config); err != nil {
+		return nil, err
+	}
+	sseC, err := newSSECustomer(config)
+	if err != nil {
+		return nil, err
+	}
+
 	c, err := createS3Client(config)
 	if err != nil {
 		return nil, err
@@ -75,6 +174,28 @@ func New(config *Config) (*Connection, error) {
 	ret := &Connection{
 		client: c,
 		config: config,
+		sseC:   sseC,
 	}
 	return ret, nil
 }
+
+// Open is New, also checking that the bucket exists and that the credentials
+// give access to it.
+func Open(ctx context.Context, config *Config) (*Connection, error) {
+	conn, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(config.Bucket),
+	})
+	err = asBackendError(config.Bucket, err)
+	if errors.Is(err, backend.ErrAccessDenied) {
+		// HeadBucket needs s3:ListBucket, which credentials limited to reading
+		// and writing objects lack. They are checked by the first transfer.
+		logging.FromContext(ctx).Warn("Unable to check access to the bucket", "bucket", config.Bucket, "error", err)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to access bucket %s: %w", config.Bucket, err)
+	}
+	return conn, nil
+}
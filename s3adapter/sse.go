@@ -0,0 +1,53 @@
+package s3adapter
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// sseCustomer holds the SSE-C parameters, which have to be sent along with
+// every request reading or writing an object.
+type sseCustomer struct {
+	algorithm *string
+	key       *string
+	keyMD5    *string
+}
+
+func validateSSE(config *Config) error {
+	switch sse := types.ServerSideEncryption(config.ServerSideEncryption); sse {
+	case "", types.ServerSideEncryptionAes256:
+		if config.SSEKMSKeyId != "" {
+			return fmt.Errorf("a KMS key id can only be set with aws:kms or aws:kms:dsse server-side encryption")
+		}
+	case types.ServerSideEncryptionAwsKms, types.ServerSideEncryptionAwsKmsDsse:
+	default:
+		return fmt.Errorf("invalid server-side encryption %s, possible values: %v", sse, sse.Values())
+	}
+	if config.SSECustomerKey != "" && config.ServerSideEncryption != "" {
+		return fmt.Errorf("customer-provided keys cannot be combined with other server-side encryption settings")
+	}
+	return nil
+}
+
+func newSSECustomer(config *Config) (sseCustomer, error) {
+	if config.SSECustomerKey == "" {
+		return sseCustomer{}, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(config.SSECustomerKey)
+	if err != nil {
+		return sseCustomer{}, fmt.Errorf("invalid customer-provided key: %v", err)
+	}
+	if len(key) != 32 {
+		return sseCustomer{}, fmt.Errorf("invalid customer-provided key: expected 256 bits, got %d", len(key)*8)
+	}
+	sum := md5.Sum(key)
+	return sseCustomer{
+		algorithm: aws.String("AES256"),
+		key:       aws.String(config.SSECustomerKey),
+		keyMD5:    aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+	}, nil
+}
@@ -1,131 +1,87 @@
 package s3adapter
 
 import (
+	"bytes"
 	"context"
-	"encoding/base64"
-	"fmt"
-	"hash/crc32"
+	"errors"
 	"io"
-	"log"
-	"math/big"
-	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	"github.com/nicolas-graves/lfs-s3/compression"
+	"github.com/nicolas-graves/lfs-s3/logging"
 )
 
-type uploadTracker struct {
-	reader   io.Reader
-	callback func(transferred int64)
-}
-
-func (u *uploadTracker) Read(p []byte) (n int, err error) {
-	n, err = u.reader.Read(p)
-	if n > 0 {
-		u.callback(int64(n))
+func (conn *Connection) Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	remotePath := conn.asLfsPath(key)
+	if conn.stateDir == "" {
+		return conn.put(ctx, remotePath, body, metadata)
 	}
-	return
-}
 
-func (conn *Connection) Upload(oid string, localPath string, callback func(transferred int64)) error {
-	log.Printf("Received upload request for %s %s", localPath, oid)
-	file, err := os.Open(localPath)
-	if err != nil {
+	// Objects which fit in a single part are not worth resuming.
+	first := make([]byte, partSize)
+	n, err := io.ReadFull(body, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return conn.put(ctx, remotePath, bytes.NewReader(first[:n]), metadata)
+	} else if err != nil {
 		return err
 	}
-	defer file.Close()
-	remotePath := conn.asLfsPath(oid) + conn.config.Compression.Extension()
-	reader, closeReader := conn.config.Compression.WrapRead(file)
-	defer closeReader()
-
-	log.Printf("Checking if file already exists")
-	if ho, err := conn.client.HeadObject(context.Background(), &s3.HeadObjectInput{
-		Bucket:       aws.String(conn.config.Bucket),
-		Key:          aws.String(remotePath),
-		ChecksumMode: types.ChecksumModeEnabled,
-	}); err == nil {
-		buffer := make([]byte, 1024*256)
-		var size int64
-		checksummer := crc32.New(crc32.MakeTable(crc32.Castagnoli))
-		for {
-			n, err := reader.Read(buffer)
-			if err != nil && err != io.EOF {
-				return err
-			}
-			if n > 0 {
-				size += int64(n)
-				if _, err := checksummer.Write(buffer[:n]); err != nil {
-					return err
-				}
-			}
-			if err == io.EOF {
-				break
-			}
-		}
-
-		if ho.ContentLength != nil && *ho.ContentLength != size {
-			return fmt.Errorf("Existing remote file has different size, local: %d, remote: %d", size, *ho.ContentLength)
-		}
-
-		if ho.ChecksumCRC32C != nil {
-			log.Printf("HeadObject checksum: %v", *ho.ChecksumCRC32C)
-
-			rawsum := checksummer.Sum32()
-			log.Printf("RawSum: 0x%x", rawsum)
-			bigIntSum := big.NewInt(int64(rawsum))
-			bytesSum := make([]byte, 4)
-			bigIntSum.FillBytes(bytesSum)
-			checksum := base64.StdEncoding.EncodeToString(bytesSum)
-			log.Printf("File checksum: %s", checksum)
-
-			if *ho.ChecksumCRC32C != checksum {
-				return fmt.Errorf("Existing remote file has different checksum, local: %v, remote: %v", checksum, *ho.ChecksumCRC32C)
-			}
-		}
-
-		log.Printf("File already present remotely, skipping upload")
-		return nil
-	}
+	return conn.putResumable(ctx, remotePath, io.MultiReader(bytes.NewReader(first), body), metadata)
+}
 
+// put uploads an object with the SDK uploader, in multiple parts if needed.
+func (conn *Connection) put(ctx context.Context, remotePath string, body io.Reader, metadata map[string]string) error {
 	uploader := manager.NewUploader(conn.client, func(u *manager.Uploader) {
 		u.PartSize = partSize
+		// The uploader aborts using the upload context, which is useless once
+		// it has been cancelled, so we abort failed uploads ourselves.
+		u.LeavePartsOnError = true
 	})
 
-	ut := &uploadTracker{
-		reader:   reader,
-		callback: callback,
-	}
-
-	log.Printf("Starting upload")
-	if _, err = uploader.Upload(context.Background(), &s3.PutObjectInput{
-		Bucket: aws.String(conn.config.Bucket),
-		Key:    aws.String(remotePath),
-		Body:   ut,
+	if _, err := uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(conn.config.Bucket),
+		Key:      aws.String(remotePath),
+		Body:     body,
+		Metadata: metadata,
+
+		ServerSideEncryption: types.ServerSideEncryption(conn.config.ServerSideEncryption),
+		SSEKMSKeyId:          nilIfEmpty(conn.config.SSEKMSKeyId),
+		SSECustomerAlgorithm: conn.sseC.algorithm,
+		SSECustomerKey:       conn.sseC.key,
+		SSECustomerKeyMD5:    conn.sseC.keyMD5,
 	}); err != nil {
+		var mu manager.MultiUploadFailure
+		if errors.As(err, &mu) {
+			conn.abortUpload(ctx, remotePath, mu.UploadID())
+		}
 		return err
 	}
-	log.Printf("Finished upload")
+	return nil
+}
 
-	if conn.config.DeleteOtherVersions {
-		for _, c := range compression.Compressions {
-			compPath := conn.asLfsPath(oid) + c.Extension()
-			if compPath == remotePath {
-				continue
-			}
-			if conn.fileExists(compPath) {
-				log.Printf("Deleting other file version: %s", compPath)
-				if _, err := conn.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
-					Bucket: aws.String(conn.config.Bucket),
-					Key:    aws.String(compPath),
-				}); err != nil {
-					log.Printf("Error deleting other file version: %v", err)
-				}
-			}
-		}
+// abortUpload aborts a failed multipart upload so that its parts are not left
+// orphaned in the bucket. This has to succeed even if ctx was cancelled.
+// Errors are logged, callers only need to check them to try again later.
+func (conn *Connection) abortUpload(ctx context.Context, key string, uploadID string) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	logging.FromContext(ctx).Info("Aborting multipart upload", "upload_id", uploadID, "remote_key", key)
+	_, err := conn.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(conn.config.Bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		logging.FromContext(ctx).Warn("Error aborting multipart upload", "upload_id", uploadID, "error", err)
 	}
+	return err
+}
 
-	return nil
+func nilIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
 }
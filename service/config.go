@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nicolas-graves/lfs-s3/backend"
+	"github.com/nicolas-graves/lfs-s3/compression"
+	"github.com/nicolas-graves/lfs-s3/encryption"
+	"github.com/nicolas-graves/lfs-s3/logging"
+)
+
+type Config struct {
+	Compression compression.Compression
+	// Rules overriding Compression for the files they match, first match
+	// winning.
+	CompressionRules    []Rule
+	DeleteOtherVersions bool
+	// Key to encrypt uploaded objects with, nil to store them in plaintext.
+	Encryption *encryption.Key
+	// Number of concurrent requests used to download each object, when it
+	// is uncompressed or compressed in independent frames.
+	DownloadConcurrency int
+	// Deadline of each transfer, 0 for none.
+	TransferTimeout time.Duration
+	// Files whose estimated compression ratio is lower are stored
+	// uncompressed. 0 to always compress them.
+	MinCompressionRatio float64
+}
+
+// version is one of the ways an object can be stored.
+type version struct {
+	comp      compression.Compression
+	encrypted bool
+}
+
+func (v version) key(oid string) string {
+	if v.encrypted {
+		return oid + v.comp.Extension() + encryption.Extension
+	}
+	return oid + v.comp.Extension()
+}
+
+// raw reports whether objects stored as v are stored as is, so that any
+// range of them can be downloaded independently.
+func (v version) raw() bool {
+	_, none := v.comp.(*compression.None)
+	return none && !v.encrypted
+}
+
+// framed returns the compression of objects stored as v if their frames can
+// be downloaded independently.
+func (v version) framed() (compression.Framed, bool) {
+	framed, ok := v.comp.(compression.Framed)
+	return framed, ok && !v.encrypted
+}
+
+// uploadVersion returns the version objects compressed with comp are uploaded as.
+func (config *Config) uploadVersion(comp compression.Compression) version {
+	return version{comp: comp, encrypted: config.Encryption != nil}
+}
+
+// downloadVersions returns the versions objects can be downloaded from, in
+// order of preference. Encrypted versions are preferred when a key is set,
+// and ignored otherwise.
+func (config *Config) downloadVersions() []version {
+	var versions []version
+	if config.Encryption != nil {
+		for _, c := range compression.Registered() {
+			versions = append(versions, version{comp: c, encrypted: true})
+		}
+	}
+	for _, c := range compression.Registered() {
+		versions = append(versions, version{comp: c})
+	}
+	return versions
+}
+
+// storedVersions returns which of versions of an object are stored, in the
+// same order, with a single listing, and whether they were listed. When the
+// backend does not list objects, or listing is denied, e.g. to credentials
+// without s3:ListBucket, it returns all of versions, to be checked one by one.
+func storedVersions(ctx context.Context, b backend.Backend, oid string, versions []version) ([]version, bool, error) {
+	lister, ok := b.(backend.Lister)
+	if !ok {
+		return versions, false, nil
+	}
+	objects, err := lister.List(ctx, oid)
+	if errors.Is(err, backend.ErrAccessDenied) {
+		logging.FromContext(ctx).Debug("Listing stored versions was denied, checking each of them", "error", err)
+		return versions, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	keys := map[string]bool{}
+	for _, o := range objects {
+		keys[o.Key] = true
+	}
+	var stored []version
+	for _, v := range versions {
+		if keys[v.key(oid)] {
+			stored = append(stored, v)
+		}
+	}
+	return stored, true, nil
+}
+
+// allVersions returns every version an object can be stored as.
+func allVersions() []version {
+	var versions []version
+	for _, encrypted := range []bool{false, true} {
+		for _, c := range compression.Registered() {
+			versions = append(versions, version{comp: c, encrypted: encrypted})
+		}
+	}
+	return versions
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/nicolas-graves/lfs-s3/backend"
+	"github.com/nicolas-graves/lfs-s3/logging"
+)
+
+type downloadTracker struct {
+	writer   io.Writer
+	callback func(transferred int64)
+}
+
+func (dt *downloadTracker) Write(p []byte) (n int, err error) {
+	n, err = dt.writer.Write(p)
+	if n > 0 {
+		dt.callback(int64(n))
+	}
+	return
+}
+
+// verifyingWriter hashes and counts the decompressed bytes on their way to disk.
+type verifyingWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func (vw *verifyingWriter) Write(p []byte) (n int, err error) {
+	n, err = vw.w.Write(p)
+	vw.hash.Write(p[:n])
+	vw.size += int64(n)
+	return
+}
+
+func download(ctx context.Context, b backend.Backend, config *Config, lfsDir string, oid string, size int64, localPath string, callback func(transferred int64)) error {
+	var v *version
+	var info *backend.ObjectInfo
+	var key string
+	// S3 denies reading missing objects to credentials which cannot list the
+	// bucket, so denied versions are skipped like missing ones.
+	var denied error
+
+	candidates, _, err := storedVersions(ctx, b, oid, config.downloadVersions())
+	if err != nil {
+		return err
+	}
+	for _, candidate := range candidates {
+		k := candidate.key(oid)
+		logging.FromContext(ctx).Debug("Checking stored version", "key", k)
+		i, err := b.Stat(ctx, k)
+		if errors.Is(err, backend.ErrNotFound) {
+			continue
+		} else if errors.Is(err, backend.ErrAccessDenied) {
+			denied = err
+			continue
+		} else if err != nil {
+			return err
+		}
+		v = &candidate
+		info = i
+		key = k
+		break
+	}
+
+	if v == nil && denied != nil {
+		return fmt.Errorf("No downloadable version of the file was found: %w", denied)
+	} else if v == nil {
+		return fmt.Errorf("No downloadable version of the file was found: %w", backend.ErrNotFound)
+	}
+
+	ctx = logging.With(ctx, "key", key, "compression", v.comp.Name(), "encrypted", v.encrypted)
+	logging.FromContext(ctx).Info("Downloading")
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	framed, isFramed := v.framed()
+	if v.raw() || isFramed {
+		return downloadResumable(ctx, b, config, info, framed, lfsDir, oid, size, localPath, callback)
+	}
+
+	// Stream into a temporary file in the LFS temporary directory, like
+	// git-lfs, so that only verified objects are ever renamed into the LFS
+	// object store.
+	tmpDir := filepath.Join(lfsDir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(tmpDir, oid+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	written, sum, err := downloadStream(ctx, b, config, *v, key, file, callback)
+	if err != nil {
+		return err
+	}
+	if err := verify(oid, size, written, sum); err != nil {
+		return err
+	}
+	if err := commit(file, localPath); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// verify checks that a downloaded file has the expected size and SHA-256.
+func verify(oid string, size int64, written int64, sum []byte) error {
+	if written != size {
+		return mismatch("Downloaded file has wrong size, expected: %d, got: %d", size, written)
+	}
+	if sum := hex.EncodeToString(sum); sum != oid {
+		return mismatch("Downloaded file has wrong checksum, expected: %s, got: %s", oid, sum)
+	}
+	return nil
+}
+
+// commit renames a verified download into place.
+func commit(file *os.File, localPath string) error {
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), localPath)
+}
+
+// downloadStream downloads an object in order, decrypting and decompressing
+// it on the fly, and returns the size and SHA-256 of what was written.
+func downloadStream(ctx context.Context, b backend.Backend, config *Config, v version, key string, file io.Writer, callback func(transferred int64)) (int64, []byte, error) {
+	// Progress is tracked on the decompressed content, like the size git-lfs
+	// expects.
+	dt := &downloadTracker{
+		writer:   file,
+		callback: callback,
+	}
+	vw := &verifyingWriter{w: dt, hash: sha256.New()}
+	writer, closeWriter := v.comp.WrapWrite(vw)
+	var decrypter io.WriteCloser
+	if v.encrypted {
+		decrypter = config.Encryption.Decrypt(writer)
+		writer = decrypter
+	}
+
+	err := b.Get(ctx, key, writer)
+	if err == nil && decrypter != nil {
+		err = decrypter.Close()
+	}
+	closeWriter()
+	if err != nil {
+		return 0, nil, err
+	}
+	return vw.size, vw.hash.Sum(nil), nil
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/nicolas-graves/lfs-s3/api"
+	"github.com/nicolas-graves/lfs-s3/backend"
+	"github.com/nicolas-graves/lfs-s3/encryption"
+)
+
+// mismatchError reports stored content which differs from the expected one.
+type mismatchError struct {
+	msg string
+}
+
+func (e *mismatchError) Error() string {
+	return e.msg
+}
+
+func mismatch(format string, args ...any) error {
+	return &mismatchError{fmt.Sprintf(format, args...)}
+}
+
+// errorCode returns the code reporting err to git-lfs.
+func errorCode(err error) int {
+	var me *mismatchError
+	var statusErr interface{ HTTPStatusCode() int }
+	var netErr net.Error
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.Is(err, backend.ErrNotFound):
+		return api.CodeNotFound
+	case errors.Is(err, backend.ErrAccessDenied):
+		return api.CodeAccessDenied
+	case errors.As(err, &me), errors.Is(err, backend.ErrChanged), errors.Is(err, encryption.ErrInvalid):
+		return api.CodeMismatch
+	case errors.Is(err, context.DeadlineExceeded):
+		return api.CodeTimeout
+	case errors.As(err, &statusErr):
+		return statusCode(statusErr.HTTPStatusCode())
+	case errors.As(err, &netErr):
+		return api.CodeUnavailable
+	case errors.As(err, &pathErr), errors.As(err, &linkErr):
+		return api.CodeLocalIO
+	}
+	return api.CodeError
+}
+
+// statusCode maps the status of a failed HTTP response to an error code.
+func statusCode(status int) int {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return api.CodeAccessDenied
+	case status == http.StatusNotFound:
+		return api.CodeNotFound
+	case status == http.StatusPreconditionFailed:
+		return api.CodeMismatch
+	case status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500:
+		return api.CodeUnavailable
+	}
+	// Other statuses, e.g. 400 for invalid SSE-C parameters, would be mistaken
+	// for the codes of other errors.
+	return api.CodeError
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// git runs a git command in the current directory and returns its trimmed output.
+func git(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", strings.Join(args, " "), msg)
+		}
+		return "", fmt.Errorf("git %s: %w", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// lfsStorageDir resolves the directory git-lfs keeps its data in, the same
+// way git-lfs does: lfs.storage if set (relative paths being resolved against
+// the common git directory), <common git dir>/lfs otherwise. Using the common
+// git directory makes this work for worktrees, submodules and GIT_DIR.
+func lfsStorageDir() (string, error) {
+	commonDir, err := git("rev-parse", "--git-common-dir")
+	if err != nil {
+		return "", fmt.Errorf("unable to locate the git directory: %v", err)
+	}
+	commonDir, err = filepath.Abs(commonDir)
+	if err != nil {
+		return "", err
+	}
+
+	// git config exits with 1 when the key is unset, which is not an error here.
+	storage, _ := git("config", "--get", "lfs.storage")
+	if storage == "" {
+		return filepath.Join(commonDir, "lfs"), nil
+	}
+	if !filepath.IsAbs(storage) {
+		storage = filepath.Join(commonDir, storage)
+	}
+	return filepath.Clean(storage), nil
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nicolas-graves/lfs-s3/api"
+)
+
+// Progress is reported at most every progressInterval, unless more than
+// progressBytes were transferred since the last report.
+const (
+	progressInterval = 200 * time.Millisecond
+	progressBytes    = 64 * 1024 * 1024
+)
+
+// progress coalesces the progress of a transfer before reporting it to
+// git-lfs, rather than sending a message for every chunk transferred.
+type progress struct {
+	oid    string
+	stdout io.Writer
+
+	mu       sync.Mutex
+	total    int64
+	reported int64
+	last     time.Time
+}
+
+func newProgress(oid string, stdout io.Writer) *progress {
+	return &progress{oid: oid, stdout: stdout, last: time.Now()}
+}
+
+// add records transferred bytes, reporting them if it is time to.
+func (p *progress) add(transferred int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total += transferred
+	if time.Since(p.last) >= progressInterval || p.total-p.reported >= progressBytes {
+		p.report()
+	}
+}
+
+// flush reports the bytes transferred since the last report, if any.
+func (p *progress) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.total != p.reported {
+		p.report()
+	}
+}
+
+func (p *progress) report() {
+	api.SendProgress(p.oid, p.total, int(p.total-p.reported), p.stdout)
+	p.reported = p.total
+	p.last = time.Now()
+}
@@ -0,0 +1,319 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/nicolas-graves/lfs-s3/backend"
+	"github.com/nicolas-graves/lfs-s3/compression"
+	"github.com/nicolas-graves/lfs-s3/logging"
+)
+
+// Size of the ranges fetched concurrently by parallel downloads, in bytes.
+const rangeSize = 8 * 1024 * 1024
+
+// part is a range of a stored object which can be downloaded on its own.
+type part struct {
+	index  int
+	offset int64
+	length int64
+	// Offset the part content is written at in the downloaded file, and size
+	// of that content.
+	target int64
+	size   int64
+	// Decompresses the part, nil if it is stored as is.
+	decode func(src []byte) ([]byte, error)
+}
+
+// rawParts splits a raw object in ranges of rangeSize bytes.
+func rawParts(size int64) []part {
+	var parts []part
+	for offset := int64(0); offset < size; offset += rangeSize {
+		parts = append(parts, part{index: len(parts), offset: offset, length: min(rangeSize, size-offset), target: offset, size: min(rangeSize, size-offset)})
+	}
+	return parts
+}
+
+// framedParts reads the index of a framed object and returns its frames,
+// which must decompress to size bytes.
+func framedParts(ctx context.Context, b backend.Backend, info *backend.ObjectInfo, framed compression.Framed, size int64) ([]part, error) {
+	frames, err := framed.ReadIndex(info.Size, func(length int64) ([]byte, error) {
+		body, err := b.GetRange(ctx, info.Key, info.Size-length, length, info.ETag)
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+		return io.ReadAll(io.LimitReader(body, length))
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Checked before buffers of the decompressed size of frames are allocated.
+	var total int64
+	for _, f := range frames {
+		total += f.DecompressedSize
+	}
+	if total != size {
+		return nil, mismatch("Frames have wrong total size, expected: %d, got: %d", size, total)
+	}
+	parts := make([]part, len(frames))
+	for i, f := range frames {
+		parts[i] = part{
+			index:  i,
+			offset: f.Offset,
+			length: f.Size,
+			target: f.DecompressedOffset,
+			size:   f.DecompressedSize,
+			decode: func(src []byte) ([]byte, error) {
+				dst, err := framed.DecodeFrame(src, make([]byte, 0, f.DecompressedSize))
+				if err == nil && int64(len(dst)) != f.DecompressedSize {
+					err = mismatch("Frame at offset %d has wrong size, expected: %d, got: %d", f.Offset, f.DecompressedSize, len(dst))
+				}
+				return dst, err
+			},
+		}
+	}
+	return parts, nil
+}
+
+// resumeState records the progress of a partial download, so that it can be
+// resumed as long as the remote object is unchanged.
+type resumeState struct {
+	Key  string `json:"key"`
+	ETag string `json:"etag"`
+	// Indexes of the parts already written to the partial file.
+	Done []int `json:"done"`
+}
+
+func loadResumeState(ctx context.Context, path string) (*resumeState, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state resumeState
+	if err := json.Unmarshal(content, &state); err != nil {
+		logging.FromContext(ctx).Warn("Ignoring invalid download state", "path", path, "error", err)
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func (state *resumeState) save(path string) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// downloadResumable downloads an object whose parts can be fetched
+// independently: concurrently, and into a partial file kept in the LFS
+// directory of incomplete downloads along with a state file, so that an
+// interrupted download is resumed on the next attempt.
+func downloadResumable(ctx context.Context, b backend.Backend, config *Config, info *backend.ObjectInfo, framed compression.Framed, lfsDir string, oid string, size int64, localPath string, callback func(transferred int64)) error {
+	incompleteDir := filepath.Join(lfsDir, "incomplete")
+	if err := os.MkdirAll(incompleteDir, 0755); err != nil {
+		return err
+	}
+	// Named apart from the partial downloads of git-lfs, which are written
+	// in order.
+	partialPath := filepath.Join(incompleteDir, oid+".lfs-s3.part")
+	statePath := partialPath + ".json"
+	discard := func() {
+		os.Remove(partialPath)
+		os.Remove(statePath)
+	}
+
+	parts := rawParts(info.Size)
+	if framed != nil {
+		var err error
+		if parts, err = framedParts(ctx, b, info, framed, size); err != nil {
+			return err
+		}
+	}
+
+	state, err := loadResumeState(ctx, statePath)
+	if err != nil {
+		return err
+	}
+	if state != nil && (info.ETag == "" || state.Key != info.Key || state.ETag != info.ETag) {
+		logging.FromContext(ctx).Info("Remote file changed since the partial download, restarting it")
+		state = nil
+	}
+	if state != nil {
+		// The partial file may have been removed or truncated since the parts
+		// were recorded as done.
+		var end int64
+		for _, p := range parts {
+			if slices.Contains(state.Done, p.index) {
+				end = max(end, p.target+p.size)
+			}
+		}
+		if fi, err := os.Stat(partialPath); err != nil || fi.Size() < end {
+			logging.FromContext(ctx).Info("Partial download is missing parts, restarting it")
+			state = nil
+		}
+	}
+	flags := os.O_RDWR | os.O_CREATE
+	if state == nil {
+		state = &resumeState{Key: info.Key, ETag: info.ETag}
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(partialPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var pending []part
+	var resumed int64
+	for _, p := range parts {
+		if slices.Contains(state.Done, p.index) {
+			resumed += p.size
+		} else {
+			pending = append(pending, p)
+		}
+	}
+	if resumed > 0 {
+		logging.FromContext(ctx).Info("Resuming download", "parts_left", len(pending), "parts", len(parts))
+		callback(resumed)
+	}
+
+	// Parts are only recorded as done once they are on disk.
+	done := func(p part) error {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+		state.Done = append(state.Done, p.index)
+		return state.save(statePath)
+	}
+	concurrency := max(config.DownloadConcurrency, 1)
+	logging.FromContext(ctx).Debug("Downloading parts", "concurrency", concurrency)
+	if err := downloadParts(ctx, b, info, pending, file, concurrency, callback, done); err != nil {
+		if errors.Is(err, backend.ErrChanged) {
+			discard()
+		}
+		return err
+	}
+
+	written, sum, err := hashFile(file)
+	if err != nil {
+		return err
+	}
+	if err := verify(oid, size, written, sum); err != nil {
+		discard()
+		return err
+	}
+	if err := commit(file, localPath); err != nil {
+		return err
+	}
+	os.Remove(statePath)
+	return nil
+}
+
+// downloadParts downloads parts of an object with concurrent ranged requests,
+// writing each of them at its target offset in file. Calls to callback and
+// done are serialized.
+func downloadParts(ctx context.Context, b backend.Backend, info *backend.ObjectInfo, parts []part, file io.WriterAt, concurrency int, callback func(transferred int64), done func(p part) error) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	queue := make(chan part, len(parts))
+	for _, p := range parts {
+		queue <- p
+	}
+	close(queue)
+
+	var mu sync.Mutex
+	report := func(transferred int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		callback(transferred)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+				err := downloadPart(ctx, b, info, p, file, report)
+				if err == nil {
+					mu.Lock()
+					err = done(p)
+					mu.Unlock()
+				}
+				if err != nil {
+					cancel(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+func downloadPart(ctx context.Context, b backend.Backend, info *backend.ObjectInfo, p part, file io.WriterAt, callback func(transferred int64)) error {
+	body, err := b.GetRange(ctx, info.Key, p.offset, p.length, info.ETag)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	dt := &downloadTracker{
+		writer:   io.NewOffsetWriter(file, p.target),
+		callback: callback,
+	}
+	var n int64
+	if p.decode == nil {
+		n, err = io.Copy(dt, io.LimitReader(body, p.length))
+	} else {
+		var src, content []byte
+		if src, err = io.ReadAll(io.LimitReader(body, p.length)); err != nil {
+			return err
+		}
+		n = int64(len(src))
+		if content, err = p.decode(src); err != nil {
+			return err
+		}
+		_, err = dt.Write(content)
+	}
+	if err != nil {
+		return err
+	}
+	if n != p.length {
+		return mismatch("Short read at offset %d of %s, expected: %d, got: %d", p.offset, info.Key, p.length, n)
+	}
+	return nil
+}
+
+// hashFile returns the size and SHA-256 of a file.
+func hashFile(file io.ReadSeeker) (int64, []byte, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, hash.Sum(nil), nil
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/nicolas-graves/lfs-s3/compression"
+	"github.com/nicolas-graves/lfs-s3/logging"
+)
+
+// Rule chooses the compression of the files whose path in the repository
+// matches a glob.
+type Rule struct {
+	Pattern     string
+	Compression compression.Compression
+	re          *regexp.Regexp
+}
+
+// NewRule returns a rule for pattern, a glob in which "*" and "?" match within
+// a path component and "**" matches across them. Patterns without a slash
+// match the name of files in any directory, like in .gitattributes.
+func NewRule(pattern string, comp compression.Compression) (Rule, error) {
+	glob := strings.TrimPrefix(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		glob = "**/" + glob
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+	}
+	return Rule{Pattern: pattern, Compression: comp, re: re}, nil
+}
+
+// Match reports whether a path, relative to the root of the repository,
+// matches the rule.
+func (r Rule) Match(path string) bool {
+	return r.re.MatchString(path)
+}
+
+// ParseRules parses rules, one "<glob> <compression>" per line. Empty lines
+// and lines starting with "#" are ignored.
+func ParseRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a glob and a compression, got %q", n, line)
+		}
+		comp, err := compression.Parse(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		rule, err := NewRule(fields[0], comp)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// LoadRules reads rules from a file.
+func LoadRules(path string) ([]Rule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rules, err := ParseRules(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return rules, nil
+}
+
+// pathIndex maps LFS object IDs to the paths of the files they are the
+// content of in the current commit. git-lfs only sends the path of its copy
+// of the object, which says nothing about the file.
+type pathIndex struct {
+	load func() (map[string][]string, error)
+}
+
+func newPathIndex() *pathIndex {
+	return &pathIndex{load: sync.OnceValues(lfsPaths)}
+}
+
+// lfsPaths finds the LFS pointers in HEAD.
+func lfsPaths() (map[string][]string, error) {
+	out, err := git("grep", "-z", "-I", "-E", "^oid sha256:[0-9a-f]{64}$", "HEAD", "--", ":(top)")
+	// git grep exits with 1 when nothing matches.
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	paths := map[string][]string{}
+	for _, line := range strings.Split(out, "\n") {
+		name, pointer, ok := strings.Cut(line, "\x00")
+		if !ok {
+			continue
+		}
+		oid := strings.TrimPrefix(pointer, "oid sha256:")
+		paths[oid] = append(paths[oid], strings.TrimPrefix(name, "HEAD:"))
+	}
+	return paths, nil
+}
+
+// compressionFor returns the compression of the first rule matching one of
+// the paths of an object in HEAD, or the default compression.
+func (config *Config) compressionFor(ctx context.Context, paths *pathIndex, oid string) compression.Compression {
+	if len(config.CompressionRules) == 0 {
+		return config.Compression
+	}
+	index, err := paths.load()
+	if err != nil {
+		logging.FromContext(ctx).Warn("Unable to find the paths of LFS files, using the default compression", "error", err)
+		return config.Compression
+	}
+	if _, ok := index[oid]; !ok {
+		// e.g. when pushing other branches than the checked-out one.
+		logging.FromContext(ctx).Info("File is not in the checked-out commit, compression rules do not apply")
+		return config.Compression
+	}
+	for _, rule := range config.CompressionRules {
+		for _, path := range index[oid] {
+			if rule.Match(path) {
+				logging.FromContext(ctx).Debug("Compression rule matched", "path", path, "pattern", rule.Pattern)
+				return rule.Compression
+			}
+		}
+	}
+	return config.Compression
+}
@@ -2,89 +2,183 @@ package service
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/nicolas-graves/lfs-s3/api"
-	"github.com/nicolas-graves/lfs-s3/s3adapter"
+	"github.com/nicolas-graves/lfs-s3/backend"
+	"github.com/nicolas-graves/lfs-s3/logging"
 )
 
-func Serve(stdin io.Reader, stdout, stderr io.Writer, config *s3adapter.Config) error {
-	if config.Bucket == "" {
-		return fmt.Errorf("no bucket set")
-	}
-	if config.Endpoint == "" {
-		return fmt.Errorf("no endpoint set")
-	}
-	if config.Compression == nil {
-		return fmt.Errorf("invalid compression set")
-	}
-	if (config.AccessKeyId == "") != (config.SecretAccessKey == "") {
-		return fmt.Errorf("access key and secret key should either both be set or both be empty")
-	}
+// syncWriter serializes writes so that messages sent from concurrent
+// transfers never interleave.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
 
-	conn, err := s3adapter.New(config)
-	if err != nil {
-		return err
+func (sw *syncWriter) Write(p []byte) (n int, err error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Write(p)
+}
+
+// Serve runs the custom transfer protocol on stdin/stdout, storing objects in
+// the backend opened by open. The configuration is checked and the backend
+// opened on init, so that failures are reported to git-lfs.
+func Serve(stdin io.Reader, stdout io.Writer, open backend.Opener, config *Config) error {
+	slog.Debug("Serving LFS")
+
+	// Cancelled on terminate, stdin EOF or SIGINT/SIGTERM, aborting in-flight transfers.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	stdout = &syncWriter{w: stdout}
+
+	var b backend.Backend
+	var lfsDir string
+	paths := newPathIndex()
+	var workers sync.WaitGroup
+	var jobs chan api.Request
+	startWorkers := func(n int) {
+		slog.Debug("Starting transfer workers", "count", n)
+		jobs = make(chan api.Request, n)
+		for i := 0; i < n; i++ {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				for req := range jobs {
+					transfer(ctx, b, config, lfsDir, paths, req, stdout)
+				}
+			}()
+		}
 	}
-	log.Printf("Serving LFS")
+	defer func() {
+		cancel()
+		if jobs != nil {
+			close(jobs)
+			workers.Wait()
+		}
+	}()
 
 	scanner := bufio.NewScanner(stdin)
 	for scanner.Scan() {
 		line := scanner.Text()
-		log.Printf("Read line %s", line)
+		slog.Debug("Read line", "line", line)
 		var req api.Request
 		if err := json.Unmarshal([]byte(line), &req); err != nil {
 			return fmt.Errorf("error reading input: %s", err)
 		}
-		log.Printf("Received request %+v", req)
 		switch req.Event {
 		case "init":
-			api.SendInit(0, nil, stdout, stderr)
-		case "terminate":
-			log.Printf("Terminating test custom adapter gracefully.")
-		case "download":
-			lp, err := localPath(req.Oid)
-			if err != nil {
-				return err
-			}
-			var bytesProcessed int64
-			callback := func(transferred int64) {
-				bytesProcessed += transferred
-				api.SendProgress(req.Oid, bytesProcessed, int(transferred), stdout, stderr)
+			if jobs == nil {
+				var err error
+				if b, lfsDir, err = initialize(ctx, open, config); err != nil {
+					slog.Error("Initialization failed", "error", err)
+					api.SendInit(errorCode(err), err, stdout)
+					continue
+				}
+				startWorkers(concurrency(req))
 			}
-			if err := conn.Download(req.Oid, lp, callback); err != nil {
-				api.SendTransfer(req.Oid, 1, err, lp, stdout, stderr)
-			} else {
-				api.SendTransfer(req.Oid, 0, nil, lp, stdout, stderr)
-			}
-		case "upload":
-			var bytesProcessed int64
-			callback := func(transferred int64) {
-				bytesProcessed += transferred
-				api.SendProgress(req.Oid, bytesProcessed, int(transferred), stdout, stderr)
-			}
-
-			if err := conn.Upload(req.Oid, req.Path, callback); err != nil {
-				api.SendTransfer(req.Oid, 1, err, "", stdout, stderr)
-			} else {
-				api.SendTransfer(req.Oid, 0, nil, "", stdout, stderr)
+			api.SendInit(0, nil, stdout)
+		case "terminate":
+			slog.Debug("Terminating")
+			return nil
+		case "download", "upload":
+			if jobs == nil {
+				api.SendTransfer(req.Event, req.Oid, api.CodeBadRequest, fmt.Errorf("adapter is not initialized"), "", stdout)
+				continue
 			}
+			jobs <- req
 		default:
-			log.Printf("Unknown event: %s", req.Event)
+			slog.Warn("Unknown event", "event", req.Event)
 		}
 	}
 	return nil
 }
 
+// initialize opens the backend, which may complete the configuration, checks
+// the configuration and locates the LFS storage directory.
+func initialize(ctx context.Context, open backend.Opener, config *Config) (backend.Backend, string, error) {
+	b, err := open(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Compression == nil {
+		return nil, "", fmt.Errorf("invalid compression set")
+	}
+	lfsDir, err := lfsStorageDir()
+	if err != nil {
+		return nil, "", err
+	}
+	slog.Debug("Using LFS storage directory", "path", lfsDir)
+	if r, ok := b.(backend.Resumable); ok {
+		r.SetStateDir(ctx, filepath.Join(lfsDir, "lfs-s3", "uploads"))
+	}
+	return b, lfsDir, nil
+}
+
+// concurrency returns the number of transfers to run in parallel, as
+// requested by git-lfs during init.
+func concurrency(req api.Request) int {
+	if !req.Concurrent || req.ConcurrentTransfers < 1 {
+		return 1
+	}
+	return req.ConcurrentTransfers
+}
+
+func transfer(ctx context.Context, b backend.Backend, config *Config, lfsDir string, paths *pathIndex, req api.Request, stdout io.Writer) {
+	if config.TransferTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.TransferTimeout)
+		defer cancel()
+	}
+	ctx = logging.With(ctx, "event", req.Event, "oid", req.Oid, "size", req.Size)
+	logger := logging.FromContext(ctx)
+	logger.Debug("Starting transfer")
+	start := time.Now()
+
+	p := newProgress(req.Oid, stdout)
+	var path string
+	var err error
+	switch req.Event {
+	case "download":
+		if path, err = localPath(lfsDir, req.Oid); err != nil {
+			logger.Error("Invalid transfer", "error", err)
+			api.SendTransfer(req.Event, req.Oid, api.CodeBadRequest, err, "", stdout)
+			return
+		}
+		err = download(ctx, b, config, lfsDir, req.Oid, req.Size, path, p.add)
+	case "upload":
+		err = upload(ctx, b, config, paths, req.Oid, req.Path, p.add)
+	}
+	p.flush()
+
+	if err != nil {
+		code := errorCode(err)
+		logger.Error("Transfer failed", "code", code, "error", err, "duration", time.Since(start))
+		api.SendTransfer(req.Event, req.Oid, code, err, path, stdout)
+	} else {
+		logger.Info("Transfer finished", "duration", time.Since(start))
+		api.SendTransfer(req.Event, req.Oid, 0, nil, path, stdout)
+	}
+}
+
 var oidRegex = regexp.MustCompile(`^[a-f0-9]{64}$`)
 
-func localPath(oid string) (string, error) {
+func localPath(lfsDir string, oid string) (string, error) {
 	if !oidRegex.MatchString(oid) {
 		return "", fmt.Errorf("Invalid lfs object ID %s", oid)
 	}
-	return fmt.Sprintf(".git/lfs/objects/%s/%s/%s", oid[:2], oid[2:4], oid), nil
+	return filepath.Join(lfsDir, "objects", oid[:2], oid[2:4], oid), nil
 }
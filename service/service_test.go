@@ -0,0 +1,1244 @@
+package service_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nicolas-graves/lfs-s3/api"
+	"github.com/nicolas-graves/lfs-s3/backend"
+	"github.com/nicolas-graves/lfs-s3/compression"
+	"github.com/nicolas-graves/lfs-s3/encryption"
+	"github.com/nicolas-graves/lfs-s3/fsadapter"
+	"github.com/nicolas-graves/lfs-s3/s3adapter"
+	"github.com/nicolas-graves/lfs-s3/service"
+	"github.com/nicolas-graves/lfs-s3/test/fakes3"
+)
+
+const bucket = "testbucket"
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// session drives service.Serve through its stdin and stdout, like git-lfs.
+type session struct {
+	t      *testing.T
+	stdin  *io.PipeWriter
+	stdout *bufio.Scanner
+	done   chan error
+	// Progress reports received so far.
+	progress []api.ProgressResponse
+}
+
+func serve(t *testing.T, b backend.Backend, config *service.Config) *session {
+	t.Helper()
+	return serveWith(t, func(context.Context) (backend.Backend, error) { return b, nil }, config)
+}
+
+func serveWith(t *testing.T, open backend.Opener, config *service.Config) *session {
+	t.Helper()
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	s := &session{t: t, stdin: stdinW, stdout: bufio.NewScanner(stdoutR), done: make(chan error, 1)}
+	go func() {
+		err := service.Serve(stdinR, stdoutW, open, config)
+		stdoutW.Close()
+		s.done <- err
+	}()
+	return s
+}
+
+func (s *session) send(req api.Request) {
+	s.t.Helper()
+	line, err := json.Marshal(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if _, err := s.stdin.Write(append(line, '\n')); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// receive returns the next message which is not a progress report.
+func (s *session) receive() api.TransferResponse {
+	s.t.Helper()
+	for s.stdout.Scan() {
+		var resp api.TransferResponse
+		if err := json.Unmarshal(s.stdout.Bytes(), &resp); err != nil {
+			s.t.Fatalf("invalid response %q: %v", s.stdout.Text(), err)
+		}
+		if resp.Event != "progress" {
+			return resp
+		}
+		var progress api.ProgressResponse
+		if err := json.Unmarshal(s.stdout.Bytes(), &progress); err != nil {
+			s.t.Fatalf("invalid progress report %q: %v", s.stdout.Text(), err)
+		}
+		s.progress = append(s.progress, progress)
+	}
+	s.t.Fatalf("no response: %v", s.stdout.Err())
+	return api.TransferResponse{}
+}
+
+func (s *session) init(operation string) {
+	s.t.Helper()
+	s.send(api.Request{Event: "init", Operation: operation, Concurrent: true, ConcurrentTransfers: 2})
+	if resp := s.receive(); resp.Error != nil {
+		s.t.Fatalf("init failed: %+v", resp.Error)
+	}
+}
+
+func (s *session) transfer(req api.Request) api.TransferResponse {
+	s.t.Helper()
+	s.send(req)
+	resp := s.receive()
+	if resp.Event != "complete" || resp.Oid != req.Oid {
+		s.t.Fatalf("unexpected response to %s of %s: %+v", req.Event, req.Oid, resp)
+	}
+	return resp
+}
+
+func (s *session) terminate() {
+	s.t.Helper()
+	s.send(api.Request{Event: "terminate"})
+	s.stdin.Close()
+	if err := <-s.done; err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// setup creates a git repository to run in and a bucket to store objects in.
+func setup(t *testing.T) (*fakes3.Server, backend.Backend) {
+	t.Helper()
+	return setupWith(t, func(*s3adapter.Config) {})
+}
+
+// setupWith is setup with a customized S3 configuration.
+func setupWith(t *testing.T, configure func(*s3adapter.Config)) (*fakes3.Server, backend.Backend) {
+	t.Helper()
+	gitRepo(t)
+	server := fakes3.New()
+	t.Cleanup(server.Close)
+	server.CreateBucket(bucket)
+	return server, connect(t, server, configure)
+}
+
+// gitRepo creates a git repository to run in.
+func gitRepo(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	dir := t.TempDir()
+	if out, err := exec.Command("git", "init", "-q", dir).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+	t.Chdir(dir)
+}
+
+// setupFile creates a git repository to run in and a directory to store
+// objects in with the file backend.
+func setupFile(t *testing.T) backend.Backend {
+	t.Helper()
+	gitRepo(t)
+	b, err := fsadapter.New(&fsadapter.Config{RootPath: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func connect(t *testing.T, server *fakes3.Server, configure func(*s3adapter.Config)) backend.Backend {
+	t.Helper()
+	config := &s3adapter.Config{
+		AccessKeyId:     "access",
+		SecretAccessKey: "secret",
+		Bucket:          bucket,
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		UsePathStyle:    true,
+	}
+	configure(config)
+	conn, err := s3adapter.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// objectRequests counts the requests with the given method on objects, as
+// opposed to the bucket.
+func objectRequests(server *fakes3.Server, method string) int {
+	count := 0
+	for _, r := range server.Requests() {
+		if strings.HasPrefix(r, method+" /"+bucket+"/") {
+			count++
+		}
+	}
+	return count
+}
+
+// object writes data to a file outside of the LFS storage and returns its oid.
+func object(t *testing.T, data []byte) (string, string) {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	oid := hex.EncodeToString(sum[:])
+	path := filepath.Join(t.TempDir(), oid)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return oid, path
+}
+
+func randomData(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func upload(t *testing.T, b backend.Backend, config *service.Config, oid, path string, size int) {
+	t.Helper()
+	s := serve(t, b, config)
+	s.init("upload")
+	resp := s.transfer(api.Request{Event: "upload", Oid: oid, Size: int64(size), Path: path})
+	if resp.Error != nil {
+		t.Fatalf("upload failed: %+v", resp.Error)
+	}
+	s.terminate()
+}
+
+func download(t *testing.T, b backend.Backend, config *service.Config, oid string, size int) api.TransferResponse {
+	t.Helper()
+	s := serve(t, b, config)
+	s.init("download")
+	resp := s.transfer(api.Request{Event: "download", Oid: oid, Size: int64(size)})
+	s.terminate()
+	return resp
+}
+
+func assertDownloaded(t *testing.T, resp api.TransferResponse, data []byte) {
+	t.Helper()
+	if resp.Error != nil {
+		t.Fatalf("download failed: %+v", resp.Error)
+	}
+	got, err := os.ReadFile(resp.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("downloaded file differs from the uploaded one")
+	}
+}
+
+func TestUploadDownload(t *testing.T) {
+	for _, c := range compression.Registered() {
+		t.Run(c.Name(), func(t *testing.T) {
+			server, b := setup(t)
+			config := &service.Config{Compression: c}
+			data := bytes.Repeat([]byte("Simple, compressible text\n"), 1000)
+			oid, path := object(t, data)
+
+			upload(t, b, config, oid, path, len(data))
+			if keys := server.Keys(bucket); !slices.Equal(keys, []string{oid + c.Extension()}) {
+				t.Fatalf("unexpected keys in bucket: %v", keys)
+			}
+
+			resp := download(t, b, config, oid, len(data))
+			assertDownloaded(t, resp, data)
+			if want := filepath.Join(".git", "lfs", "objects", oid[:2], oid[2:4], oid); !filepath.IsAbs(resp.Path) || !bytes.HasSuffix([]byte(resp.Path), []byte(want)) {
+				t.Fatalf("unexpected download path %s", resp.Path)
+			}
+		})
+	}
+}
+
+// gatedBackend holds each Stat until n are in flight at once, or until a
+// timeout expired, and records the most Stats in flight.
+type gatedBackend struct {
+	backend.Backend
+	n        int
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+	open     chan struct{}
+	once     sync.Once
+}
+
+func gate(b backend.Backend, n int) *gatedBackend {
+	g := &gatedBackend{Backend: b, n: n, open: make(chan struct{})}
+	time.AfterFunc(5*time.Second, g.release)
+	return g
+}
+
+func (g *gatedBackend) release() {
+	g.once.Do(func() { close(g.open) })
+}
+
+func (g *gatedBackend) Stat(ctx context.Context, key string) (*backend.ObjectInfo, error) {
+	g.mu.Lock()
+	g.inFlight++
+	g.peak = max(g.peak, g.inFlight)
+	if g.inFlight == g.n {
+		g.release()
+	}
+	g.mu.Unlock()
+	<-g.open
+	g.mu.Lock()
+	g.inFlight--
+	g.mu.Unlock()
+	return g.Backend.Stat(ctx, key)
+}
+
+func TestConcurrentTransfers(t *testing.T) {
+	_, b := setup(t)
+	config := &service.Config{Compression: &compression.Zstd{}}
+	const concurrency = 4
+	files := map[string][]byte{}
+	paths := map[string]string{}
+	for i := 0; i < 2*concurrency; i++ {
+		data := randomData(t, 3*1024*1024)
+		oid, path := object(t, data)
+		files[oid], paths[oid] = data, path
+	}
+
+	for _, event := range []string{"upload", "download"} {
+		gated := gate(b, concurrency)
+		s := serve(t, gated, config)
+		s.send(api.Request{Event: "init", Operation: event, Concurrent: true, ConcurrentTransfers: concurrency})
+		if resp := s.receive(); resp.Error != nil {
+			t.Fatalf("init failed: %+v", resp.Error)
+		}
+		// All transfers are queued before any completes, from another
+		// goroutine so that a smaller pool cannot block them behind unread
+		// responses. receive checks that every line is a valid message, which
+		// interleaved writes would not be.
+		var requests bytes.Buffer
+		for oid, data := range files {
+			line, err := json.Marshal(api.Request{Event: event, Oid: oid, Size: int64(len(data)), Path: paths[oid]})
+			if err != nil {
+				t.Fatal(err)
+			}
+			requests.Write(append(line, '\n'))
+		}
+		go s.stdin.Write(requests.Bytes())
+		completed := map[string]bool{}
+		for range files {
+			resp := s.receive()
+			if resp.Event != "complete" || resp.Error != nil {
+				t.Fatalf("%s failed: %+v", event, resp)
+			}
+			if event == "download" {
+				assertDownloaded(t, resp, files[resp.Oid])
+			}
+			completed[resp.Oid] = true
+		}
+		s.terminate()
+		if len(completed) != len(files) {
+			t.Fatalf("expected %d distinct %ss to complete, got %d", len(files), event, len(completed))
+		}
+		if gated.peak != concurrency {
+			t.Fatalf("expected %d concurrent %ss, got %d", concurrency, event, gated.peak)
+		}
+	}
+}
+
+func TestUploadSkipsExistingObject(t *testing.T) {
+	server, b := setup(t)
+	config := &service.Config{Compression: &compression.Zstd{}}
+	data := randomData(t, 1024)
+	oid, path := object(t, data)
+
+	upload(t, b, config, oid, path, len(data))
+	puts := server.CountRequests("PUT")
+	upload(t, b, config, oid, path, len(data))
+	if got := server.CountRequests("PUT"); got != puts {
+		t.Fatalf("existing object was uploaded again")
+	}
+}
+
+func TestCompressionSwitch(t *testing.T) {
+	server, b := setup(t)
+	data := bytes.Repeat([]byte("Simple, compressible text\n"), 1000)
+	oid, path := object(t, data)
+
+	upload(t, b, &service.Config{Compression: &compression.Zstd{}}, oid, path, len(data))
+	config := &service.Config{Compression: &compression.Gzip{}, DeleteOtherVersions: true}
+	upload(t, b, config, oid, path, len(data))
+	if keys := server.Keys(bucket); !slices.Equal(keys, []string{oid + ".gz"}) {
+		t.Fatalf("unexpected keys in bucket: %v", keys)
+	}
+
+	// Downloads must find the object whatever the configured compression.
+	resp := download(t, b, &service.Config{Compression: &compression.Zstd{}}, oid, len(data))
+	assertDownloaded(t, resp, data)
+}
+
+func TestMultipartUpload(t *testing.T) {
+	server, b := setup(t)
+	config := &service.Config{Compression: &compression.None{}}
+	data := randomData(t, 12*1024*1024+42)
+	oid, path := object(t, data)
+
+	upload(t, b, config, oid, path, len(data))
+	if server.CountRequests("POST") == 0 {
+		t.Fatalf("object was not uploaded in multiple parts")
+	}
+	if n := server.Uploads(); n != 0 {
+		t.Fatalf("%d multipart uploads left in progress", n)
+	}
+
+	resp := download(t, b, config, oid, len(data))
+	assertDownloaded(t, resp, data)
+}
+
+func TestDownloadCorruptObject(t *testing.T) {
+	server, b := setup(t)
+	config := &service.Config{Compression: &compression.None{}}
+	oid, _ := object(t, []byte("original"))
+	server.PutObject(bucket, oid, []byte("tampered"))
+
+	resp := download(t, b, config, oid, len("original"))
+	if resp.Error == nil {
+		t.Fatalf("corrupt object was downloaded")
+	}
+	if resp.Error.Code != api.CodeMismatch {
+		t.Fatalf("expected code %d, got %+v", api.CodeMismatch, resp.Error)
+	}
+	assertNoFilesLeft(t, oid)
+}
+
+// assertNoFilesLeft checks that a download left nothing behind but the
+// downloaded object.
+func assertNoFilesLeft(t *testing.T, oid string) {
+	t.Helper()
+	for _, pattern := range []string{
+		filepath.Join(".git", "lfs", "objects", oid[:2], oid[2:4], oid+"?*"),
+		filepath.Join(".git", "lfs", "tmp", "*"),
+		filepath.Join(".git", "lfs", "incomplete", "*"),
+	} {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			t.Fatalf("failed download left files behind: %v", files)
+		}
+	}
+}
+
+func TestDownloadCorruptCompressedObject(t *testing.T) {
+	server, b := setup(t)
+	config := &service.Config{Compression: &compression.Zstd{}}
+	oid, _ := object(t, []byte("original"))
+	reader, closeReader := config.Compression.WrapRead(strings.NewReader("tampered"))
+	tampered, err := io.ReadAll(reader)
+	closeReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.PutObject(bucket, oid+".zstd", tampered)
+
+	resp := download(t, b, config, oid, len("original"))
+	if resp.Error == nil || resp.Error.Code != api.CodeMismatch {
+		t.Fatalf("expected code %d, got %+v", api.CodeMismatch, resp.Error)
+	}
+	assertNoFilesLeft(t, oid)
+}
+
+func TestDownloadCorruptSeekableIndex(t *testing.T) {
+	server, b := setup(t)
+	config := &service.Config{Compression: &compression.ZstdSeekable{}}
+	oid, _ := object(t, []byte("original"))
+	reader, closeReader := config.Compression.WrapRead(strings.NewReader("tampered content"))
+	tampered, err := io.ReadAll(reader)
+	closeReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.PutObject(bucket, oid+".seekable.zstd", tampered)
+
+	resp := download(t, b, config, oid, len("original"))
+	if resp.Error == nil || resp.Error.Code != api.CodeMismatch {
+		t.Fatalf("expected code %d, got %+v", api.CodeMismatch, resp.Error)
+	}
+	assertNoFilesLeft(t, oid)
+}
+
+func TestDownloadMissingObject(t *testing.T) {
+	_, b := setup(t)
+	config := &service.Config{Compression: &compression.Zstd{}}
+	oid, _ := object(t, []byte("missing"))
+
+	resp := download(t, b, config, oid, len("missing"))
+	if resp.Error == nil {
+		t.Fatalf("missing object was downloaded")
+	}
+	if resp.Error.Code != api.CodeNotFound {
+		t.Fatalf("expected code %d, got %+v", api.CodeNotFound, resp.Error)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	server, b := setup(t)
+	key, err := encryption.KeyFromPassphrase("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := &service.Config{Compression: &compression.Zstd{}, DeleteOtherVersions: true}
+	encrypted := &service.Config{Compression: &compression.Zstd{}, DeleteOtherVersions: true, Encryption: key}
+	data := bytes.Repeat([]byte("Proprietary asset\n"), 1000)
+	oid, path := object(t, data)
+
+	// Uploading with a key replaces the plaintext version.
+	upload(t, b, plain, oid, path, len(data))
+	upload(t, b, encrypted, oid, path, len(data))
+	if keys := server.Keys(bucket); !slices.Equal(keys, []string{oid + ".zstd.enc"}) {
+		t.Fatalf("unexpected keys in bucket: %v", keys)
+	}
+	stored, _ := server.Object(bucket, oid+".zstd.enc")
+	if decoded, err := zstdDecode(stored); err == nil && bytes.Equal(decoded, data) {
+		t.Fatalf("object was stored in plaintext")
+	}
+
+	puts := server.CountRequests("PUT")
+	upload(t, b, encrypted, oid, path, len(data))
+	if got := server.CountRequests("PUT"); got != puts {
+		t.Fatalf("existing encrypted object was uploaded again")
+	}
+
+	assertDownloaded(t, download(t, b, encrypted, oid, len(data)), data)
+	if resp := download(t, b, plain, oid, len(data)); resp.Error == nil {
+		t.Fatalf("encrypted object was downloaded without a key")
+	}
+}
+
+func zstdDecode(data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	w, closeWriter := (&compression.Zstd{}).WrapWrite(&out)
+	_, err := w.Write(data)
+	closeWriter()
+	return out.Bytes(), err
+}
+
+func TestServerSideEncryption(t *testing.T) {
+	server, b := setupWith(t, func(c *s3adapter.Config) {
+		c.ServerSideEncryption = "aws:kms"
+		c.SSEKMSKeyId = "lfs-key"
+	})
+	config := &service.Config{Compression: &compression.None{}}
+	data := randomData(t, 1024)
+	oid, path := object(t, data)
+
+	upload(t, b, config, oid, path, len(data))
+	if algorithm, keyId := server.Encryption(bucket, oid); algorithm != "aws:kms" || keyId != "lfs-key" {
+		t.Fatalf("unexpected server-side encryption: %s %s", algorithm, keyId)
+	}
+}
+
+func TestServerSideEncryptionCustomerKey(t *testing.T) {
+	customerKey := base64.StdEncoding.EncodeToString(randomData(t, 32))
+	server, b := setupWith(t, func(c *s3adapter.Config) { c.SSECustomerKey = customerKey })
+	config := &service.Config{Compression: &compression.Zstd{}}
+	data := randomData(t, 6*1024*1024)
+	oid, path := object(t, data)
+
+	upload(t, b, config, oid, path, len(data))
+	puts := server.CountRequests("PUT")
+	upload(t, b, config, oid, path, len(data))
+	if got := server.CountRequests("PUT"); got != puts {
+		t.Fatalf("existing object was uploaded again")
+	}
+	assertDownloaded(t, download(t, b, config, oid, len(data)), data)
+
+	other := connect(t, server, func(c *s3adapter.Config) {
+		c.SSECustomerKey = base64.StdEncoding.EncodeToString(randomData(t, 32))
+	})
+	resp := download(t, other, config, oid, len(data))
+	if resp.Error == nil {
+		t.Fatalf("object was downloaded with the wrong customer key")
+	}
+	// S3 rejects the key with a 400 status, which is not a bad request from
+	// git-lfs.
+	if resp.Error.Code != api.CodeError {
+		t.Fatalf("expected code %d, got %+v", api.CodeError, resp.Error)
+	}
+}
+
+func TestInvalidDownloadRequest(t *testing.T) {
+	_, b := setup(t)
+	s := serve(t, b, &service.Config{Compression: &compression.Zstd{}})
+	s.init("download")
+	resp := s.transfer(api.Request{Event: "download", Oid: "../../config", Size: 1})
+	s.terminate()
+	if resp.Error == nil || resp.Error.Code != api.CodeBadRequest {
+		t.Fatalf("expected code %d, got %+v", api.CodeBadRequest, resp.Error)
+	}
+	if !strings.HasPrefix(resp.Error.Message, "Error downloading file") {
+		t.Fatalf("expected a download error, got %q", resp.Error.Message)
+	}
+}
+
+func TestUploadRecordsMetadata(t *testing.T) {
+	_, b := setup(t)
+	config := &service.Config{Compression: &compression.Gzip{}}
+	data := randomData(t, 1024)
+	oid, path := object(t, data)
+
+	upload(t, b, config, oid, path, len(data))
+	info, err := b.Stat(context.Background(), oid+".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"lfs-oid": oid, "lfs-size": "1024", "lfs-compression": "gzip"}
+	if !maps.Equal(info.Metadata, want) {
+		t.Fatalf("unexpected metadata: %v", info.Metadata)
+	}
+}
+
+func TestUploadChecksLegacyObjects(t *testing.T) {
+	server, b := setup(t)
+	config := &service.Config{Compression: &compression.None{}}
+	data := randomData(t, 1024)
+	oid, path := object(t, data)
+
+	// Objects uploaded by older versions have no metadata.
+	server.PutObject(bucket, oid, data)
+	puts := server.CountRequests("PUT")
+	upload(t, b, config, oid, path, len(data))
+	if got := server.CountRequests("PUT"); got != puts {
+		t.Fatalf("existing object was uploaded again")
+	}
+
+	server.PutObject(bucket, oid, data[1:])
+	s := serve(t, b, config)
+	s.init("upload")
+	resp := s.transfer(api.Request{Event: "upload", Oid: oid, Size: int64(len(data)), Path: path})
+	if resp.Error == nil {
+		t.Fatalf("different existing object was not reported")
+	}
+	if resp.Error.Code != api.CodeMismatch {
+		t.Fatalf("expected code %d, got %+v", api.CodeMismatch, resp.Error)
+	}
+	s.terminate()
+}
+
+func TestParallelDownload(t *testing.T) {
+	server, b := setup(t)
+	config := &service.Config{Compression: &compression.None{}, DownloadConcurrency: 4}
+	data := randomData(t, 20*1024*1024+42)
+	oid, path := object(t, data)
+
+	upload(t, b, config, oid, path, len(data))
+	gets := objectRequests(server, "GET")
+	assertDownloaded(t, download(t, b, config, oid, len(data)), data)
+	if got := objectRequests(server, "GET") - gets; got != 3 {
+		t.Fatalf("expected 3 ranged requests, got %d", got)
+	}
+}
+
+func TestFramedDownload(t *testing.T) {
+	server, b := setup(t)
+	config := &service.Config{Compression: &compression.ZstdSeekable{}, DownloadConcurrency: 4}
+	data := append(randomData(t, 5*1024*1024), make([]byte, 5*1024*1024)...)
+	oid, path := object(t, data)
+
+	upload(t, b, config, oid, path, len(data))
+	gets := objectRequests(server, "GET")
+	assertDownloaded(t, download(t, b, config, oid, len(data)), data)
+	// Two requests for the seek table, then one per frame.
+	if got := objectRequests(server, "GET") - gets; got != 5 {
+		t.Fatalf("expected 5 ranged requests, got %d", got)
+	}
+}
+
+func TestVersionsAreListed(t *testing.T) {
+	server, b := setup(t)
+	key, err := encryption.KeyFromPassphrase("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &service.Config{Compression: &compression.None{}, Encryption: key, DeleteOtherVersions: true}
+	data := []byte("listed")
+	oid, path := object(t, data)
+
+	upload(t, b, &service.Config{Compression: &compression.Zstd{}}, oid, path, len(data))
+	heads, lists := objectRequests(server, "HEAD"), server.CountRequests("GET")-objectRequests(server, "GET")
+	upload(t, b, config, oid, path, len(data))
+	// One check of the uploaded version and one listing, which finds the
+	// version to delete.
+	if got := objectRequests(server, "HEAD") - heads; got != 1 {
+		t.Fatalf("expected 1 HEAD request on upload, got %d", got)
+	}
+	if got := server.CountRequests("GET") - objectRequests(server, "GET") - lists; got != 1 {
+		t.Fatalf("expected 1 listing on upload, got %d", got)
+	}
+	if keys := server.Keys(bucket); len(keys) != 1 {
+		t.Fatalf("expected only the encrypted version to be left, got %v", keys)
+	}
+
+	heads = objectRequests(server, "HEAD")
+	assertDownloaded(t, download(t, b, &service.Config{Compression: &compression.Zstd{}, Encryption: key}, oid, len(data)), data)
+	if got := objectRequests(server, "HEAD") - heads; got != 1 {
+		t.Fatalf("expected 1 HEAD request on download, got %d", got)
+	}
+}
+
+// seedPartialDownload leaves the first range of an object on disk, as an
+// interrupted download would, recorded against the given ETag.
+func seedPartialDownload(t *testing.T, oid, etag string, data []byte) {
+	t.Helper()
+	dir := filepath.Join(".git", "lfs", "incomplete")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	partial := filepath.Join(dir, oid+".lfs-s3.part")
+	if err := os.WriteFile(partial, data[:8*1024*1024], 0644); err != nil {
+		t.Fatal(err)
+	}
+	state := fmt.Sprintf(`{"key":%q,"etag":%q,"done":[0]}`, oid, etag)
+	if err := os.WriteFile(partial+".json", []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+	server, b := setup(t)
+	config := &service.Config{Compression: &compression.None{}, DownloadConcurrency: 4}
+	data := randomData(t, 20*1024*1024+42)
+	oid, path := object(t, data)
+
+	upload(t, b, config, oid, path, len(data))
+	info, err := b.Stat(context.Background(), oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedPartialDownload(t, oid, info.ETag, data)
+	gets := objectRequests(server, "GET")
+	resp := download(t, b, config, oid, len(data))
+	assertDownloaded(t, resp, data)
+	if got := objectRequests(server, "GET") - gets; got != 2 {
+		t.Fatalf("expected 2 ranged requests, got %d", got)
+	}
+	assertNoFilesLeft(t, oid)
+}
+
+func TestResumeDownloadChangedObject(t *testing.T) {
+	server, b := setup(t)
+	config := &service.Config{Compression: &compression.None{}, DownloadConcurrency: 4}
+	data := randomData(t, 20*1024*1024+42)
+	oid, path := object(t, data)
+
+	upload(t, b, config, oid, path, len(data))
+	// The partial content is stale, it must not end up in the download.
+	seedPartialDownload(t, oid, `"stale"`, make([]byte, len(data)))
+	gets := objectRequests(server, "GET")
+	assertDownloaded(t, download(t, b, config, oid, len(data)), data)
+	if got := objectRequests(server, "GET") - gets; got != 3 {
+		t.Fatalf("expected 3 ranged requests, got %d", got)
+	}
+}
+
+func TestResumeDownloadTruncatedPartialFile(t *testing.T) {
+	for _, truncate := range []func(path string) error{
+		os.Remove,
+		func(path string) error { return os.Truncate(path, 1024) },
+	} {
+		server, b := setup(t)
+		config := &service.Config{Compression: &compression.None{}, DownloadConcurrency: 4}
+		data := randomData(t, 20*1024*1024+42)
+		oid, path := object(t, data)
+
+		upload(t, b, config, oid, path, len(data))
+		info, err := b.Stat(context.Background(), oid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seedPartialDownload(t, oid, info.ETag, data)
+		if err := truncate(filepath.Join(".git", "lfs", "incomplete", oid+".lfs-s3.part")); err != nil {
+			t.Fatal(err)
+		}
+		gets := objectRequests(server, "GET")
+		assertDownloaded(t, download(t, b, config, oid, len(data)), data)
+		if got := objectRequests(server, "GET") - gets; got != 3 {
+			t.Fatalf("expected 3 ranged requests, got %d", got)
+		}
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	server, b := setup(t)
+	config := &service.Config{Compression: &compression.None{}}
+	data := randomData(t, 12*1024*1024+42)
+	oid, path := object(t, data)
+
+	interruptUpload(t, server, b, config, oid, path, len(data))
+	puts, posts := server.CountRequests("PUT"), server.CountRequests("POST")
+	upload(t, b, config, oid, path, len(data))
+	// Only the failed part is sent again, and the upload is completed.
+	if got := server.CountRequests("PUT") - puts; got != 1 {
+		t.Fatalf("expected 1 part to be uploaded, got %d", got)
+	}
+	if got := server.CountRequests("POST") - posts; got != 1 {
+		t.Fatalf("expected the upload to be completed without being created again, got %d POST requests", got)
+	}
+	if n := server.Uploads(); n != 0 {
+		t.Fatalf("%d multipart uploads left in progress", n)
+	}
+	assertNoUploadState(t)
+	assertDownloaded(t, download(t, b, config, oid, len(data)), data)
+}
+
+// interruptUpload leaves the multipart upload of a file in progress, as an
+// interrupted push does.
+func interruptUpload(t *testing.T, server *fakes3.Server, b backend.Backend, config *service.Config, oid, path string, size int) {
+	t.Helper()
+	server.FailUploadPart(3)
+	s := serve(t, b, config)
+	s.init("upload")
+	if resp := s.transfer(api.Request{Event: "upload", Oid: oid, Size: int64(size), Path: path}); resp.Error == nil {
+		t.Fatalf("upload succeeded despite a failing part")
+	}
+	s.terminate()
+	server.FailUploadPart(0)
+	if n := server.Uploads(); n != 1 {
+		t.Fatalf("expected the failed upload to be kept for resuming, got %d uploads", n)
+	}
+}
+
+func uploadStates(t *testing.T) []string {
+	t.Helper()
+	states, err := filepath.Glob(filepath.Join(".git", "lfs", "lfs-s3", "uploads", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return states
+}
+
+func assertNoUploadState(t *testing.T) {
+	t.Helper()
+	if states := uploadStates(t); len(states) != 0 {
+		t.Fatalf("upload state left behind: %v", states)
+	}
+}
+
+func TestDiscardUploadOfStoredObject(t *testing.T) {
+	server, b := setup(t)
+	config := &service.Config{Compression: &compression.None{}}
+	data := randomData(t, 12*1024*1024+42)
+	oid, path := object(t, data)
+
+	interruptUpload(t, server, b, config, oid, path, len(data))
+	// Meanwhile, the object is pushed from another machine.
+	metadata := map[string]string{"lfs-oid": oid, "lfs-size": fmt.Sprint(len(data)), "lfs-compression": "none"}
+	if err := connect(t, server, func(*s3adapter.Config) {}).Put(context.Background(), oid, bytes.NewReader(data), metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	upload(t, b, config, oid, path, len(data))
+	if n := server.Uploads(); n != 0 {
+		t.Fatalf("%d multipart uploads left in progress", n)
+	}
+	assertNoUploadState(t)
+}
+
+func TestDiscardUploadWithOtherCompression(t *testing.T) {
+	server, b := setup(t)
+	data := randomData(t, 12*1024*1024+42)
+	oid, path := object(t, data)
+
+	interruptUpload(t, server, b, &service.Config{Compression: &compression.None{}}, oid, path, len(data))
+	upload(t, b, &service.Config{Compression: &compression.Zstd{}}, oid, path, len(data))
+	if n := server.Uploads(); n != 0 {
+		t.Fatalf("%d multipart uploads left in progress", n)
+	}
+	assertNoUploadState(t)
+}
+
+func TestDiscardStaleUploads(t *testing.T) {
+	server, b := setup(t)
+	config := &service.Config{Compression: &compression.None{}}
+	data := randomData(t, 12*1024*1024+42)
+	oid, path := object(t, data)
+
+	interruptUpload(t, server, b, config, oid, path, len(data))
+	old := time.Now().Add(-8 * 24 * time.Hour)
+	for _, state := range uploadStates(t) {
+		if err := os.Chtimes(state, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := serve(t, b, config)
+	s.init("download")
+	s.terminate()
+	if n := server.Uploads(); n != 0 {
+		t.Fatalf("%d stale multipart uploads left in progress", n)
+	}
+	assertNoUploadState(t)
+}
+
+func TestFileBackendUploadDownload(t *testing.T) {
+	b := setupFile(t)
+	data := append(randomData(t, 1024), bytes.Repeat([]byte("lfs-s3"), 1024)...)
+	oid, path := object(t, data)
+	for _, c := range compression.Registered() {
+		t.Run(c.Name(), func(t *testing.T) {
+			config := &service.Config{Compression: c, DeleteOtherVersions: true}
+			upload(t, b, config, oid, path, len(data))
+			assertDownloaded(t, download(t, b, config, oid, len(data)), data)
+			os.Remove(filepath.Join(".git", "lfs", "objects", oid[:2], oid[2:4], oid))
+		})
+	}
+	var stored []string
+	for _, c := range compression.Registered() {
+		if _, err := b.Stat(context.Background(), oid+c.Extension()); err == nil {
+			stored = append(stored, c.Name())
+		}
+	}
+	if len(stored) != 1 {
+		t.Fatalf("expected other versions to be deleted, got %v", stored)
+	}
+}
+
+func TestFileBackendSkipsExistingObject(t *testing.T) {
+	b := setupFile(t)
+	config := &service.Config{Compression: &compression.Zstd{}}
+	data := []byte("stored once")
+	oid, path := object(t, data)
+
+	upload(t, b, config, oid, path, len(data))
+	before, err := b.Stat(context.Background(), oid+".zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload(t, b, config, oid, path, len(data))
+	after, err := b.Stat(context.Background(), oid+".zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.ETag != before.ETag {
+		t.Fatalf("existing object was written again")
+	}
+}
+
+func TestFileBackendMetadata(t *testing.T) {
+	b := setupFile(t)
+	config := &service.Config{Compression: &compression.Gzip{}}
+	data := []byte("described")
+	oid, path := object(t, data)
+
+	upload(t, b, config, oid, path, len(data))
+	info, err := b.Stat(context.Background(), oid+".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"lfs-oid": oid, "lfs-size": fmt.Sprint(len(data)), "lfs-compression": "gzip"}
+	if !maps.Equal(info.Metadata, want) {
+		t.Fatalf("expected metadata %v, got %v", want, info.Metadata)
+	}
+}
+
+func TestFileBackendRangedDownload(t *testing.T) {
+	b := setupFile(t)
+	data := append(randomData(t, 10*1024*1024), make([]byte, 10*1024*1024+42)...)
+	oid, path := object(t, data)
+	for _, c := range []compression.Compression{&compression.None{}, &compression.ZstdSeekable{}} {
+		t.Run(c.Name(), func(t *testing.T) {
+			config := &service.Config{Compression: c, DownloadConcurrency: 4}
+			upload(t, b, config, oid, path, len(data))
+			assertDownloaded(t, download(t, b, config, oid, len(data)), data)
+			os.Remove(filepath.Join(".git", "lfs", "objects", oid[:2], oid[2:4], oid))
+		})
+	}
+}
+
+func TestFileBackendResumeDownload(t *testing.T) {
+	b := setupFile(t)
+	config := &service.Config{Compression: &compression.None{}, DownloadConcurrency: 4}
+	data := randomData(t, 20*1024*1024+42)
+	oid, path := object(t, data)
+
+	upload(t, b, config, oid, path, len(data))
+	info, err := b.Stat(context.Background(), oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedPartialDownload(t, oid, info.ETag, data)
+	resp := download(t, b, config, oid, len(data))
+	assertDownloaded(t, resp, data)
+	os.Remove(resp.Path)
+
+	// The first range is not downloaded again: it is taken from the partial
+	// file, whose content proves it.
+	partial := bytes.Clone(data)
+	copy(partial, "resumed")
+	seedPartialDownload(t, oid, info.ETag, partial)
+	resp = download(t, b, config, oid, len(data))
+	if resp.Error == nil || resp.Error.Code != api.CodeMismatch {
+		t.Fatalf("expected the resumed content to be verified, got %+v", resp.Error)
+	}
+
+	// Stale partial content is discarded.
+	seedPartialDownload(t, oid, `"stale"`, make([]byte, len(data)))
+	resp = download(t, b, config, oid, len(data))
+	assertDownloaded(t, resp, data)
+	assertNoFilesLeft(t, oid)
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	server, b := setupWith(t, func(c *s3adapter.Config) {
+		c.MaxAttempts = 3
+		c.MaxBackoff = 10 * time.Millisecond
+	})
+	config := &service.Config{Compression: &compression.None{}}
+	data := []byte("retried")
+	oid, path := object(t, data)
+
+	server.FailRequests(2)
+	upload(t, b, config, oid, path, len(data))
+	server.FailRequests(2)
+	assertDownloaded(t, download(t, b, config, oid, len(data)), data)
+
+	// Attempts are exhausted.
+	server.FailRequests(3)
+	resp := download(t, b, config, oid, len(data))
+	if resp.Error == nil {
+		t.Fatalf("download succeeded despite failing requests")
+	}
+	if resp.Error.Code != api.CodeUnavailable {
+		t.Fatalf("expected code %d, got %+v", api.CodeUnavailable, resp.Error)
+	}
+}
+
+// opener opens a bucket of server on init, as the command does.
+func opener(server *fakes3.Server, bucketName string) backend.Opener {
+	return func(ctx context.Context) (backend.Backend, error) {
+		return s3adapter.Open(ctx, &s3adapter.Config{
+			AccessKeyId:     "access",
+			SecretAccessKey: "secret",
+			Bucket:          bucketName,
+			Endpoint:        server.URL,
+			Region:          "us-east-1",
+			UsePathStyle:    true,
+		})
+	}
+}
+
+func TestInitReportsErrors(t *testing.T) {
+	server, _ := setup(t)
+	s := serveWith(t, opener(server, "missing"), &service.Config{Compression: &compression.None{}})
+	s.send(api.Request{Event: "init", Operation: "download"})
+	resp := s.receive()
+	if resp.Error == nil || resp.Error.Code != api.CodeNotFound {
+		t.Fatalf("expected init to fail with code %d, got %+v", api.CodeNotFound, resp.Error)
+	}
+	oid, _ := object(t, []byte("data"))
+	if resp := s.transfer(api.Request{Event: "download", Oid: oid, Size: 4}); resp.Error == nil {
+		t.Fatalf("download succeeded without initialization")
+	}
+	s.terminate()
+}
+
+func TestInitWithoutListBucket(t *testing.T) {
+	server, _ := setup(t)
+	server.DenyListBucket()
+	s := serveWith(t, opener(server, bucket), &service.Config{Compression: &compression.None{}})
+	s.init("upload")
+	s.terminate()
+}
+
+func TestTransfersWithoutListBucket(t *testing.T) {
+	server, b := setup(t)
+	server.DenyListBucket()
+	data := []byte("least privilege")
+	oid, path := object(t, data)
+
+	upload(t, b, &service.Config{Compression: &compression.None{}, DeleteOtherVersions: true}, oid, path, len(data))
+	if _, ok := server.Object(bucket, oid); !ok {
+		t.Fatalf("object was not uploaded")
+	}
+	// Versions of higher priority are missing, and reading them is denied.
+	assertDownloaded(t, download(t, b, &service.Config{Compression: &compression.Zstd{}}, oid, len(data)), data)
+
+	missing, _ := object(t, []byte("missing"))
+	resp := download(t, b, &service.Config{Compression: &compression.Zstd{}}, missing, 7)
+	if resp.Error == nil || resp.Error.Code != api.CodeAccessDenied {
+		t.Fatalf("expected the download to fail with code %d, got %+v", api.CodeAccessDenied, resp.Error)
+	}
+}
+
+func TestProgressIsThrottled(t *testing.T) {
+	_, b := setup(t)
+	config := &service.Config{Compression: &compression.None{}}
+	data := randomData(t, 20*1024*1024)
+	oid, path := object(t, data)
+
+	s := serve(t, b, config)
+	s.init("upload")
+	if resp := s.transfer(api.Request{Event: "upload", Oid: oid, Size: int64(len(data)), Path: path}); resp.Error != nil {
+		t.Fatalf("upload failed: %+v", resp.Error)
+	}
+	s.terminate()
+	if n := len(s.progress); n == 0 || n > 20 {
+		t.Fatalf("expected a few progress reports, got %d", n)
+	}
+	if last := s.progress[len(s.progress)-1]; last.BytesSoFar != int64(len(data)) {
+		t.Fatalf("expected progress to reach %d bytes, got %d", len(data), last.BytesSoFar)
+	}
+}
+
+func TestProgressReachesFileSize(t *testing.T) {
+	for _, c := range compression.Registered() {
+		t.Run(c.Name(), func(t *testing.T) {
+			_, b := setup(t)
+			config := &service.Config{Compression: c}
+			data := bytes.Repeat([]byte("Simple, compressible text\n"), 100000)
+			oid, path := object(t, data)
+
+			for _, req := range []api.Request{
+				{Event: "upload", Oid: oid, Size: int64(len(data)), Path: path},
+				{Event: "download", Oid: oid, Size: int64(len(data))},
+			} {
+				s := serve(t, b, config)
+				s.init(req.Event)
+				if resp := s.transfer(req); resp.Error != nil {
+					t.Fatalf("%s failed: %+v", req.Event, resp.Error)
+				}
+				s.terminate()
+				if len(s.progress) == 0 {
+					t.Fatalf("no progress reported on %s", req.Event)
+				}
+				if last := s.progress[len(s.progress)-1]; last.BytesSoFar != int64(len(data)) {
+					t.Fatalf("expected %s progress to reach %d bytes, got %d", req.Event, len(data), last.BytesSoFar)
+				}
+			}
+		})
+	}
+}
+
+func TestAdaptiveCompression(t *testing.T) {
+	server, b := setup(t)
+	config := &service.Config{Compression: &compression.Zstd{}, MinCompressionRatio: 1.1}
+
+	random := randomData(t, 100*1024)
+	randomOid, randomPath := object(t, random)
+	upload(t, b, config, randomOid, randomPath, len(random))
+	text := bytes.Repeat([]byte("Simple, compressible text\n"), 1000)
+	textOid, textPath := object(t, text)
+	upload(t, b, config, textOid, textPath, len(text))
+
+	keys := server.Keys(bucket)
+	if !slices.Contains(keys, randomOid) || !slices.Contains(keys, textOid+".zstd") {
+		t.Fatalf("unexpected keys in bucket: %v", keys)
+	}
+	assertDownloaded(t, download(t, b, config, randomOid, len(random)), random)
+	assertDownloaded(t, download(t, b, config, textOid, len(text)), text)
+}
+
+func TestRuleMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern, path string
+		match         bool
+	}{
+		{"*.png", "image.png", true},
+		{"*.png", "assets/deep/image.png", true},
+		{"*.png", "image.png.txt", false},
+		{"assets/*.png", "assets/image.png", true},
+		{"assets/*.png", "assets/deep/image.png", false},
+		{"assets/**/*.png", "assets/image.png", true},
+		{"assets/**/*.png", "assets/deep/image.png", true},
+		{"/assets/**", "assets/deep/scene.json", true},
+		{"/assets/**", "other/assets/scene.json", false},
+		{"scene?.json", "levels/scene1.json", true},
+	} {
+		rule, err := service.NewRule(test.pattern, &compression.None{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rule.Match(test.path); got != test.match {
+			t.Errorf("%s matching %s: expected %v, got %v", test.pattern, test.path, test.match, got)
+		}
+	}
+}
+
+// commitPointer commits an LFS pointer to data at path in the repository.
+func commitPointer(t *testing.T, path string, data []byte) {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	pointer := fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%x\nsize %d\n", sum, len(data))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(pointer), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"add", path},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", path},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+}
+
+func TestCompressionRules(t *testing.T) {
+	server, b := setup(t)
+	rules, err := service.ParseRules(strings.NewReader("# Media is already compressed\n*.png none\n\ndocs/** gzip\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &service.Config{Compression: &compression.Zstd{}, CompressionRules: rules}
+
+	image := randomData(t, 1024)
+	text := []byte("Simple, compressible text\n")
+	other := []byte("Other text\n")
+	commitPointer(t, "assets/image.png", image)
+	commitPointer(t, "docs/guide/readme.txt", text)
+	commitPointer(t, "scene.txt", other)
+	// Not in HEAD, e.g. pushed from another branch.
+	uncommitted := randomData(t, 1024)
+
+	var expected []string
+	for _, f := range []struct {
+		data []byte
+		ext  string
+	}{{image, ""}, {text, ".gz"}, {other, ".zstd"}, {uncommitted, ".zstd"}} {
+		oid, path := object(t, f.data)
+		upload(t, b, config, oid, path, len(f.data))
+		expected = append(expected, oid+f.ext)
+	}
+	slices.Sort(expected)
+	if keys := server.Keys(bucket); !slices.Equal(keys, expected) {
+		t.Fatalf("expected keys %v, got %v", expected, keys)
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	for _, rules := range []string{"*.png", "*.png rar", "*.png none extra"} {
+		if _, err := service.ParseRules(strings.NewReader(rules)); err == nil {
+			t.Errorf("invalid rules %q were accepted", rules)
+		}
+	}
+}
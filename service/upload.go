@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+
+	"github.com/nicolas-graves/lfs-s3/backend"
+	"github.com/nicolas-graves/lfs-s3/compression"
+	"github.com/nicolas-graves/lfs-s3/encryption"
+	"github.com/nicolas-graves/lfs-s3/logging"
+)
+
+type uploadTracker struct {
+	reader   io.Reader
+	callback func(transferred int64)
+}
+
+func (u *uploadTracker) Read(p []byte) (n int, err error) {
+	n, err = u.reader.Read(p)
+	if n > 0 {
+		u.callback(int64(n))
+	}
+	return
+}
+
+// Metadata stored along with uploaded objects, describing their content.
+const (
+	metadataOid         = "lfs-oid"
+	metadataSize        = "lfs-size"
+	metadataCompression = "lfs-compression"
+)
+
+func objectMetadata(oid string, size int64, v version) map[string]string {
+	return map[string]string{
+		metadataOid:         oid,
+		metadataSize:        strconv.FormatInt(size, 10),
+		metadataCompression: v.comp.Name(),
+	}
+}
+
+func upload(ctx context.Context, b backend.Backend, config *Config, paths *pathIndex, oid string, localPath string, callback func(transferred int64)) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	v := config.uploadVersion(config.compressionFor(ctx, paths, oid))
+	v, err = adaptVersion(ctx, config, v, file)
+	if err != nil {
+		return err
+	}
+	key := v.key(oid)
+	metadata := objectMetadata(oid, fi.Size(), v)
+	ctx = logging.With(ctx, "key", key, "compression", v.comp.Name(), "encrypted", v.encrypted)
+	logger := logging.FromContext(ctx)
+
+	logger.Debug("Checking if file already exists")
+	info, err := b.Stat(ctx, key)
+	if errors.Is(err, backend.ErrAccessDenied) {
+		// S3 denies reading missing objects to credentials which cannot list
+		// the bucket: the upload fails if they cannot write it either.
+		logger.Debug("Checking if file exists was denied, uploading it", "error", err)
+	} else if err != nil && !errors.Is(err, backend.ErrNotFound) {
+		return err
+	}
+	if err == nil {
+		if info.Metadata[metadataOid] == "" {
+			logger.Info("Remote file has no metadata, comparing content")
+			if err := compareContent(ctx, info, file, v); err != nil {
+				return err
+			}
+		} else {
+			for k, expected := range metadata {
+				if actual := info.Metadata[k]; actual != expected {
+					return mismatch("Existing remote file has different %s, local: %s, remote: %s", k, expected, actual)
+				}
+			}
+		}
+		logger.Info("File already present remotely, skipping upload")
+		discardUploads(ctx, b, oid, "")
+		callback(fi.Size())
+		return nil
+	}
+
+	// Progress is tracked on the file, as git-lfs expects it to reach the size
+	// of the file rather than of what is stored.
+	ut := &uploadTracker{
+		reader:   file,
+		callback: callback,
+	}
+	reader, closeReader := v.comp.WrapRead(ut)
+	defer closeReader()
+	body := reader
+	if v.encrypted {
+		if body, err = config.Encryption.Encrypt(reader); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Uploading")
+	if err := b.Put(ctx, key, body, metadata); err != nil {
+		return err
+	}
+	discardUploads(ctx, b, oid, key)
+
+	if config.DeleteOtherVersions {
+		others, listed, err := storedVersions(ctx, b, oid, allVersions())
+		if err != nil {
+			logger.Warn("Error listing other file versions", "error", err)
+		}
+		for _, other := range others {
+			otherKey := other.key(oid)
+			if otherKey == key {
+				continue
+			}
+			if !listed {
+				if _, err := b.Stat(ctx, otherKey); err != nil {
+					continue
+				}
+			}
+			logger.Info("Deleting other file version", "other_key", otherKey)
+			if err := b.Delete(ctx, otherKey); err != nil {
+				logger.Warn("Error deleting other file version", "other_key", otherKey, "error", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// discardUploads discards the interrupted uploads of the versions of an
+// object other than the stored one, e.g. because it was pushed from another
+// machine or the compression changed, as they will not be resumed.
+func discardUploads(ctx context.Context, b backend.Backend, oid string, storedKey string) {
+	r, ok := b.(backend.Resumable)
+	if !ok {
+		return
+	}
+	for _, v := range allVersions() {
+		if key := v.key(oid); key != storedKey {
+			r.DiscardUpload(ctx, key)
+		}
+	}
+}
+
+// adaptVersion stores files which barely compress uncompressed, judging from
+// a sample of their head.
+func adaptVersion(ctx context.Context, config *Config, v version, file io.ReaderAt) (version, error) {
+	if _, none := v.comp.(*compression.None); none || config.MinCompressionRatio <= 0 {
+		return v, nil
+	}
+	sample := make([]byte, compression.SampleSize)
+	n, err := file.ReadAt(sample, 0)
+	if err != nil && err != io.EOF {
+		return v, err
+	}
+	ratio, err := compression.EstimateRatio(sample[:n])
+	if err != nil {
+		return v, err
+	}
+	if ratio < config.MinCompressionRatio {
+		logging.FromContext(ctx).Info("File barely compresses, storing it uncompressed", "ratio", ratio)
+		v.comp = &compression.None{}
+	}
+	return v, nil
+}
+
+// compareContent checks that an object stored without metadata has the
+// expected content, by compressing the local file again.
+func compareContent(ctx context.Context, info *backend.ObjectInfo, file io.Reader, v version) error {
+	reader, closeReader := v.comp.WrapRead(file)
+	defer closeReader()
+
+	buffer := make([]byte, 1024*256)
+	var size int64
+	checksummer := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	for {
+		n, err := reader.Read(buffer)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n > 0 {
+			size += int64(n)
+			if _, err := checksummer.Write(buffer[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	// Encrypted objects are salted, so only their size can be compared.
+	if v.encrypted {
+		size = encryption.EncryptedSize(size)
+	}
+	if info.Size != size {
+		return mismatch("Existing remote file has different size, local: %d, remote: %d", size, info.Size)
+	}
+
+	if info.ChecksumCRC32C != "" && !v.encrypted {
+		rawsum := checksummer.Sum32()
+		bigIntSum := big.NewInt(int64(rawsum))
+		bytesSum := make([]byte, 4)
+		bigIntSum.FillBytes(bytesSum)
+		checksum := base64.StdEncoding.EncodeToString(bytesSum)
+		logging.FromContext(ctx).Debug("Comparing checksums", "local", checksum, "remote", info.ChecksumCRC32C)
+
+		if info.ChecksumCRC32C != checksum {
+			return mismatch("Existing remote file has different checksum, local: %v, remote: %v", checksum, info.ChecksumCRC32C)
+		}
+	}
+	return nil
+}
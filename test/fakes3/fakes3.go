@@ -0,0 +1,600 @@
+// Package fakes3 implements an in-memory S3-compatible server for tests.
+//
+// It supports the subset of the S3 API used by lfs-s3, with path-style
+// addressing only: HeadBucket, HeadObject, GetObject (including ranges),
+// PutObject, DeleteObject, ListObjectsV2, and multipart uploads. CRC32 and
+// CRC32C checksums sent by the client are verified, and returned as full
+// object checksums when requested. Server-side encryption settings are
+// recorded, and customer-provided keys (SSE-C) must be sent again to read
+// objects. Requests are not authenticated.
+package fakes3
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type object struct {
+	data     []byte
+	etag     string
+	modified time.Time
+	// Checksum algorithm the object was uploaded with, e.g. "CRC32C".
+	checksumAlgorithm string
+	metadata          map[string]string
+	sse               sseSettings
+}
+
+// sseSettings are the server-side encryption headers an object was written with.
+type sseSettings struct {
+	algorithm      string
+	kmsKeyId       string
+	customerKeyMD5 string
+}
+
+func readSSE(r *http.Request) sseSettings {
+	return sseSettings{
+		algorithm:      r.Header.Get("X-Amz-Server-Side-Encryption"),
+		kmsKeyId:       r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"),
+		customerKeyMD5: r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5"),
+	}
+}
+
+// checkCustomerKey checks that a request accessing data encrypted with a
+// customer-provided key sends that same key.
+func checkCustomerKey(r *http.Request, sse sseSettings) error {
+	if sent := r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5"); sent != sse.customerKeyMD5 {
+		return fmt.Errorf("the customer-provided key does not match the one the object was encrypted with")
+	}
+	return nil
+}
+
+type part struct {
+	data []byte
+	etag string
+}
+
+type upload struct {
+	bucket            string
+	key               string
+	checksumAlgorithm string
+	metadata          map[string]string
+	sse               sseSettings
+	parts             map[int]*part
+}
+
+// Server is a running fake S3 server.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]*object
+	uploads  map[string]*upload
+	nextID   int
+	requests []string
+	// Number of the parts whose upload fails, 0 for none.
+	failPart int
+	// Number of requests left to fail with a transient error.
+	failRequests int
+	// Whether the credentials lack s3:ListBucket.
+	denyList bool
+}
+
+// New starts a server with no buckets.
+func New() *Server {
+	s := &Server{
+		buckets: map[string]map[string]*object{},
+		uploads: map[string]*upload{},
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// CreateBucket creates an empty bucket.
+func (s *Server) CreateBucket(bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = map[string]*object{}
+	}
+}
+
+// Keys returns the sorted keys of the objects in a bucket.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Object returns the content of an object.
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+// PutObject stores an object, creating the bucket if needed.
+func (s *Server) PutObject(bucket, key string, data []byte) {
+	s.CreateBucket(bucket)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket][key] = newObject(data, "", nil, sseSettings{})
+}
+
+// Encryption returns the server-side encryption algorithm and KMS key id an
+// object was stored with.
+func (s *Server) Encryption(bucket, key string) (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.buckets[bucket][key]
+	if !ok {
+		return "", ""
+	}
+	return o.sse.algorithm, o.sse.kmsKeyId
+}
+
+// Uploads returns the number of multipart uploads in progress.
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// FailUploadPart makes uploads of the given part number fail until it is
+// called again with 0.
+func (s *Server) FailUploadPart(number int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failPart = number
+}
+
+// FailRequests makes the next n requests fail with a transient error, as an
+// overloaded server does.
+func (s *Server) FailRequests(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failRequests = n
+}
+
+// DenyListBucket makes requests behave as with credentials lacking the
+// s3:ListBucket permission: listing and checking the bucket are denied, and
+// so is reading missing objects, rather than reported as not found.
+func (s *Server) DenyListBucket() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.denyList = true
+}
+
+// Requests returns the requests received so far, as "<method> <path>" strings.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// CountRequests returns how many requests with the given method were received.
+func (s *Server) CountRequests(method string) int {
+	count := 0
+	for _, r := range s.Requests() {
+		if strings.HasPrefix(r, method+" ") {
+			count++
+		}
+	}
+	return count
+}
+
+func newObject(data []byte, checksumAlgorithm string, metadata map[string]string, sse sseSettings) *object {
+	sum := md5.Sum(data)
+	return &object{
+		data:              data,
+		etag:              `"` + hex.EncodeToString(sum[:]) + `"`,
+		modified:          time.Now().UTC(),
+		checksumAlgorithm: checksumAlgorithm,
+		metadata:          metadata,
+		sse:               sse,
+	}
+}
+
+func newChecksum(algorithm string) hash.Hash {
+	switch algorithm {
+	case "CRC32":
+		return crc32.NewIEEE()
+	case "CRC32C":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+	return nil
+}
+
+func checksum(algorithm string, data []byte) string {
+	h := newChecksum(algorithm)
+	if h == nil {
+		return ""
+	}
+	h.Write(data)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// verifyChecksum checks the checksum header sent along with data, if any,
+// and returns the algorithm it used.
+func verifyChecksum(r *http.Request, data []byte) (string, error) {
+	for _, algorithm := range []string{"CRC32", "CRC32C"} {
+		expected := r.Header.Get("X-Amz-Checksum-" + algorithm)
+		if expected == "" {
+			continue
+		}
+		if actual := checksum(algorithm, data); actual != expected {
+			return "", fmt.Errorf("%s checksum mismatch, expected %s, got %s", algorithm, expected, actual)
+		}
+		return algorithm, nil
+	}
+	return "", nil
+}
+
+func userMetadata(r *http.Request) map[string]string {
+	metadata := map[string]string{}
+	for k, v := range r.Header {
+		if name, ok := strings.CutPrefix(strings.ToLower(k), "x-amz-meta-"); ok {
+			metadata[name] = v[0]
+		}
+	}
+	return metadata
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		writeXML(w, s3Error{Code: code, Message: message})
+	}
+}
+
+func writeXML(w io.Writer, v any) {
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	if s.failRequests > 0 {
+		s.failRequests--
+		writeError(w, r, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate")
+		return
+	}
+
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	bucket, ok := s.buckets[bucketName]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	query := r.URL.Query()
+
+	if key == "" {
+		if s.denyList {
+			writeError(w, r, http.StatusForbidden, "AccessDenied", "Access Denied")
+			return
+		}
+		switch r.Method {
+		case http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case http.MethodGet:
+			s.listObjects(w, bucket, query.Get("prefix"))
+		default:
+			writeError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "Unsupported bucket operation")
+		}
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.createMultipartUpload(w, r, bucketName, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s.uploadPart(w, r, body)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeMultipartUpload(w, r, bucket, query.Get("uploadId"), body)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		if _, ok := s.uploads[query.Get("uploadId")]; !ok {
+			writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+			return
+		}
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && query.Has("uploadId"):
+		s.listParts(w, r, query.Get("uploadId"))
+	case r.Method == http.MethodPut:
+		algorithm, err := verifyChecksum(r, body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "BadDigest", err.Error())
+			return
+		}
+		o := newObject(body, algorithm, userMetadata(r), readSSE(r))
+		bucket[key] = o
+		w.Header().Set("ETag", o.etag)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodDelete:
+		delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		o, ok := bucket[key]
+		if !ok && s.denyList {
+			writeError(w, r, http.StatusForbidden, "AccessDenied", "Access Denied")
+			return
+		} else if !ok {
+			writeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+			return
+		}
+		s.getObject(w, r, o)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "Unsupported object operation")
+	}
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, o *object) {
+	if err := checkCustomerKey(r, o.sse); err != nil {
+		writeError(w, r, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	h := w.Header()
+	if o.sse.algorithm != "" {
+		h.Set("X-Amz-Server-Side-Encryption", o.sse.algorithm)
+	}
+	h.Set("ETag", o.etag)
+	h.Set("Last-Modified", o.modified.Format(http.TimeFormat))
+	h.Set("Accept-Ranges", "bytes")
+	for k, v := range o.metadata {
+		h.Set("X-Amz-Meta-"+k, v)
+	}
+	if r.Header.Get("X-Amz-Checksum-Mode") == "ENABLED" && o.checksumAlgorithm != "" {
+		h.Set("X-Amz-Checksum-"+o.checksumAlgorithm, checksum(o.checksumAlgorithm, o.data))
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != o.etag {
+		writeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+		return
+	}
+
+	data := o.data
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" && len(o.data) > 0 {
+		start, end, err := parseRange(rng, int64(len(o.data)))
+		if err != nil {
+			writeError(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", err.Error())
+			return
+		}
+		data = o.data[start : end+1]
+		status = http.StatusPartialContent
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(o.data)))
+	}
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+// parseRange parses a single "bytes=start-end" range, as sent by the SDK.
+func parseRange(rng string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(rng, "bytes=")
+	if !ok {
+		return 0, 0, fmt.Errorf("unsupported range %q", rng)
+	}
+	first, last, _ := strings.Cut(spec, "-")
+	if first == "" {
+		// Suffix range: the last n bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid range %q", rng)
+		}
+		return max(size-n, 0), size - 1, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, fmt.Errorf("invalid range %q", rng)
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid range %q", rng)
+		}
+	}
+	return start, min(end, size-1), nil
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name        `xml:"ListBucketResult"`
+	Prefix      string          `xml:"Prefix"`
+	KeyCount    int             `xml:"KeyCount"`
+	IsTruncated bool            `xml:"IsTruncated"`
+	Contents    []objectContent `xml:"Contents"`
+}
+
+type objectContent struct {
+	Key          string `xml:"Key"`
+	Size         int    `xml:"Size"`
+	ETag         string `xml:"ETag"`
+	LastModified string `xml:"LastModified"`
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, bucket map[string]*object, prefix string) {
+	result := listBucketResult{Prefix: prefix}
+	for k, o := range bucket {
+		if strings.HasPrefix(k, prefix) {
+			result.Contents = append(result.Contents, objectContent{
+				Key:          k,
+				Size:         len(o.data),
+				ETag:         o.etag,
+				LastModified: o.modified.Format(time.RFC3339),
+			})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+func (s *Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	s.nextID++
+	id := fmt.Sprintf("upload-%d", s.nextID)
+	s.uploads[id] = &upload{
+		bucket:            bucket,
+		key:               key,
+		checksumAlgorithm: r.Header.Get("X-Amz-Checksum-Algorithm"),
+		metadata:          userMetadata(r),
+		sse:               readSSE(r),
+		parts:             map[int]*part{},
+	}
+	writeXML(w, initiateMultipartUploadResult{Bucket: bucket, Key: key, UploadId: id})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, body []byte) {
+	u, ok := s.uploads[r.URL.Query().Get("uploadId")]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+	if err := checkCustomerKey(r, u.sse); err != nil {
+		writeError(w, r, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid part number")
+		return
+	}
+	if number == s.failPart {
+		writeError(w, r, http.StatusForbidden, "AccessDenied", "Injected failure")
+		return
+	}
+	algorithm, err := verifyChecksum(r, body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "BadDigest", err.Error())
+		return
+	}
+	sum := md5.Sum(body)
+	p := &part{data: body, etag: `"` + hex.EncodeToString(sum[:]) + `"`}
+	u.parts[number] = p
+	w.Header().Set("ETag", p.etag)
+	if algorithm != "" {
+		w.Header().Set("X-Amz-Checksum-"+algorithm, checksum(algorithm, body))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket map[string]*object, id string, body []byte) {
+	u, ok := s.uploads[id]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+	var req completeMultipartUpload
+	if err := xml.Unmarshal(body, &req); err != nil || len(req.Parts) == 0 {
+		writeError(w, r, http.StatusBadRequest, "MalformedXML", "Invalid part list")
+		return
+	}
+
+	var data []byte
+	etags := md5.New()
+	for i, p := range req.Parts {
+		stored, ok := u.parts[p.PartNumber]
+		if !ok || stored.etag != p.ETag || (i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber) {
+			writeError(w, r, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found")
+			return
+		}
+		data = append(data, stored.data...)
+		raw, _ := hex.DecodeString(strings.Trim(stored.etag, `"`))
+		etags.Write(raw)
+	}
+	delete(s.uploads, id)
+
+	o := newObject(data, u.checksumAlgorithm, u.metadata, u.sse)
+	o.etag = fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(etags.Sum(nil)), len(req.Parts))
+	bucket[u.key] = o
+	writeXML(w, completeMultipartUploadResult{Bucket: u.bucket, Key: u.key, ETag: o.etag})
+}
+
+type partInfo struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int    `xml:"Size"`
+}
+
+type listPartsResult struct {
+	XMLName     xml.Name   `xml:"ListPartsResult"`
+	Bucket      string     `xml:"Bucket"`
+	Key         string     `xml:"Key"`
+	UploadId    string     `xml:"UploadId"`
+	IsTruncated bool       `xml:"IsTruncated"`
+	Parts       []partInfo `xml:"Part"`
+}
+
+func (s *Server) listParts(w http.ResponseWriter, r *http.Request, id string) {
+	u, ok := s.uploads[id]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+	result := listPartsResult{Bucket: u.bucket, Key: u.key, UploadId: id}
+	var numbers []int
+	for n := range u.parts {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	for _, n := range numbers {
+		result.Parts = append(result.Parts, partInfo{n, u.parts[n].etag, len(u.parts[n].data)})
+	}
+	writeXML(w, result)
+}